@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
@@ -13,13 +14,14 @@ import (
 	"path"
 	"path/filepath"
 	"runtime"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
-	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/sethgrid/multibar"
@@ -33,20 +35,26 @@ type Command interface {
 }
 
 var commands = map[string]Command{
+	"s3cp":     new(s3cpCmd),
 	"s3create": new(s3createCmd),
 	"s3fill":   new(s3fillCmd),
 	"s3ls":     new(s3ls),
+	"s3rm":     new(s3rmCmd),
 	"s3log":    new(s3log),
+	"s3sync":   new(s3syncCmd),
 }
 
 const usage = `amz COMMAND [ARGS...]
 
 Available commands are:
 
+	s3cp     -help
 	s3create -help
 	s3fill   -help
 	s3ls     -help
 	s3log    -help
+	s3rm     -help
+	s3sync   -help
 `
 
 func matches(err error, code string) bool {
@@ -92,48 +100,193 @@ func main() {
 	}
 	f := flag.NewFlagSet("amz", flag.ContinueOnError)
 	l := log.New(os.Stderr, "["+name+"] ", log.LstdFlags)
-	region := f.String("region", "us-east-1", "Region name.")
+	region := f.String("region", "", "Region name; defaults to the one of the profile or us-east-1.")
+	profile := f.String("profile", "", "Name of the shared config profile.")
+	roleARN := f.String("role-arn", "", "ARN of the role to assume.")
+	mfaSerial := f.String("mfa-serial", "", "Serial number of the MFA device required to assume the role.")
+	endpoint := f.String("endpoint", "", "Endpoint URL of an S3-compatible service.")
+	pathStyle := f.Bool("path-style", false, "Use path-style addressing of buckets; the default with -endpoint.")
 	cmd.Init(f, l)
 	if err := f.Parse(args); err != nil {
 		die(err)
 	}
-	cfg := &aws.Config{
-		Credentials: credentials.NewCredentials(&credentials.EnvProvider{}),
-		Region:      region,
+	cfg := &aws.Config{}
+	if *region != "" {
+		cfg.Region = region
 	}
-	if err := cmd.Run(session.New(cfg)); err != nil {
+	// The session loads credentials with the standard provider chain:
+	// environment, shared credentials and config files (including
+	// the profiles assuming roles or using SSO) and instance roles.
+	sess, err := session.NewSessionWithOptions(session.Options{
+		Config:                  *cfg,
+		Profile:                 *profile,
+		SharedConfigState:       session.SharedConfigEnable,
+		AssumeRoleTokenProvider: stscreds.StdinTokenProvider,
+	})
+	if err != nil {
 		die(err)
 	}
+	if aws.StringValue(sess.Config.Region) == "" {
+		// The region is set on the session, so the STS client created
+		// below uses it as well.
+		sess = sess.Copy(&aws.Config{Region: aws.String("us-east-1")})
+	}
+	if *roleARN != "" {
+		cfg.Credentials = stscreds.NewCredentials(sess, *roleARN, func(p *stscreds.AssumeRoleProvider) {
+			if *mfaSerial != "" {
+				p.SerialNumber = mfaSerial
+				p.TokenProvider = stscreds.StdinTokenProvider
+			}
+		})
+	}
+	if *endpoint != "" {
+		// S3-compatible services usually do not support virtual-hosted
+		// style of addressing buckets.
+		cfg.Endpoint = endpoint
+		if !isFlagSet(f, "path-style") {
+			*pathStyle = true
+		}
+	}
+	cfg.S3ForcePathStyle = pathStyle
+	// The endpoint is set on a copy of the session, so the STS client
+	// created above does not use it.
+	if err := cmd.Run(sess.Copy(cfg)); err != nil {
+		die(err)
+	}
+}
+
+func isFlagSet(f *flag.FlagSet, name string) (ok bool) {
+	f.Visit(func(fl *flag.Flag) {
+		if fl.Name == name {
+			ok = true
+		}
+	})
+	return ok
 }
 
 type s3ls struct {
-	N      int
-	Path   string
-	Bucket string
-	Log    *log.Logger
+	N         int
+	Path      string
+	Bucket    string
+	Long      bool
+	Human     bool
+	JSON      bool
+	Recursive bool
+	Log       *log.Logger
 }
 
 func (cmd *s3ls) Init(flags *flag.FlagSet, log *log.Logger) {
 	flags.IntVar(&cmd.N, "n", 0, "List max n objects.")
 	flags.StringVar(&cmd.Bucket, "bucket", "amz-bucket-"+me.Username, "Bucket name.")
 	flags.StringVar(&cmd.Path, "path", "", "Relative path within bucket.")
+	flags.BoolVar(&cmd.Long, "l", false, "Print size, modification time, storage class and ETag.")
+	flags.BoolVar(&cmd.Human, "human", false, "Print sizes in human-readable form.")
+	flags.BoolVar(&cmd.JSON, "json", false, "Print each object as a JSON object.")
+	flags.BoolVar(&cmd.Recursive, "recursive", true, "List objects under nested paths; if false, list them as directories.")
 	cmd.Log = log
 }
 
+// s3lsEntry is an object or, for non-recursive listing, a common prefix.
+type s3lsEntry struct {
+	Key          string     `json:"key"`
+	Dir          bool       `json:"dir,omitempty"`
+	Size         int64      `json:"size"`
+	LastModified *time.Time `json:"last_modified,omitempty"`
+	StorageClass string     `json:"storage_class,omitempty"`
+	ETag         string     `json:"etag,omitempty"`
+}
+
 func (cmd *s3ls) Run(session *session.Session) error {
 	svc := s3.New(session)
-	params := &s3.ListObjectsInput{
+	params := &s3.ListObjectsV2Input{
 		Bucket: aws.String(cmd.Bucket),
 	}
 	if cmd.Path != "" {
 		params.Prefix = aws.String(cmd.Path + "/")
 	}
-	return svc.ListObjectsPages(params, func(resp *s3.ListObjectsOutput, _ bool) bool {
+	if !cmd.Recursive {
+		params.Delimiter = aws.String("/")
+	}
+	if cmd.N > 0 && cmd.N < 1000 {
+		params.MaxKeys = aws.Int64(int64(cmd.N))
+	}
+	var (
+		enc        = json.NewEncoder(os.Stdout)
+		objs, dirs int
+		total      int64
+		err        error
+	)
+	emit := func(e s3lsEntry) bool {
+		if cmd.N > 0 && objs+dirs == cmd.N {
+			return false
+		}
+		if e.Dir {
+			dirs++
+		} else {
+			objs++
+			total += e.Size
+		}
+		switch {
+		case cmd.JSON:
+			if err = enc.Encode(e); err != nil {
+				return false
+			}
+		case cmd.Long && e.Dir:
+			fmt.Printf("%-19s  %10s  %-12s  %-34s  %s\n", "", "DIR", "", "", e.Key)
+		case cmd.Long:
+			t := aws.TimeValue(e.LastModified).Local().Format("2006-01-02 15:04:05")
+			fmt.Printf("%-19s  %10s  %-12s  %-34s  %s\n", t, cmd.size(e.Size), e.StorageClass, e.ETag, e.Key)
+		default:
+			fmt.Println(e.Key)
+		}
+		return true
+	}
+	errList := svc.ListObjectsV2Pages(params, func(resp *s3.ListObjectsV2Output, _ bool) bool {
+		for _, p := range resp.CommonPrefixes {
+			if !emit(s3lsEntry{Key: aws.StringValue(p.Prefix), Dir: true}) {
+				return false
+			}
+		}
 		for _, obj := range resp.Contents {
-			fmt.Println(aws.StringValue(obj.Key))
+			e := s3lsEntry{
+				Key:          aws.StringValue(obj.Key),
+				Size:         aws.Int64Value(obj.Size),
+				LastModified: obj.LastModified,
+				StorageClass: aws.StringValue(obj.StorageClass),
+				ETag:         strings.Trim(aws.StringValue(obj.ETag), `"`),
+			}
+			if !emit(e) {
+				return false
+			}
 		}
 		return true
 	})
+	if err = nonil(errList, err); err != nil {
+		return err
+	}
+	cmd.Log.Printf("objects=%d, dirs=%d, size=%s", objs, dirs, cmd.size(total))
+	return nil
+}
+
+func (cmd *s3ls) size(n int64) string {
+	if cmd.Human {
+		return humanSize(n)
+	}
+	return strconv.FormatInt(n, 10)
+}
+
+// humanSize formats the number of bytes using binary units, e.g. 1.5MiB.
+func humanSize(n int64) string {
+	const units = "KMGTPE"
+	if n < 1024 {
+		return fmt.Sprintf("%dB", n)
+	}
+	v, i := float64(n)/1024, 0
+	for v >= 1024 && i < len(units)-1 {
+		v /= 1024
+		i++
+	}
+	return fmt.Sprintf("%.1f%ciB", v, units[i])
 }
 
 type s3createCmd struct {
@@ -0,0 +1,607 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/sethgrid/multibar"
+)
+
+const (
+	minPartSize = 5 << 20
+	maxParts    = 10000
+)
+
+// size is a flag value for a number of bytes, which accepts KiB, MiB
+// and GiB suffixes.
+type size int64
+
+func (s *size) String() string {
+	return strconv.FormatInt(int64(*s), 10)
+}
+
+func (s *size) Set(v string) error {
+	n, unit := v, int64(1)
+	for _, u := range []struct {
+		suffix string
+		unit   int64
+	}{
+		{"GiB", 1 << 30}, {"MiB", 1 << 20}, {"KiB", 1 << 10},
+		{"G", 1 << 30}, {"M", 1 << 20}, {"K", 1 << 10},
+	} {
+		if strings.HasSuffix(v, u.suffix) {
+			n, unit = strings.TrimSuffix(v, u.suffix), u.unit
+			break
+		}
+	}
+	i, err := strconv.ParseInt(n, 10, 64)
+	if err != nil || i < 0 {
+		return fmt.Errorf("invalid size %q", v)
+	}
+	*s = size(i * unit)
+	return nil
+}
+
+// s3uri is a location of an object given as s3://bucket/key.
+type s3uri struct {
+	Bucket string
+	Key    string
+}
+
+func parseS3URI(s string) (s3uri, bool) {
+	if !strings.HasPrefix(s, "s3://") {
+		return s3uri{}, false
+	}
+	u, err := url.Parse(s)
+	if err != nil || u.Host == "" {
+		return s3uri{}, false
+	}
+	return s3uri{Bucket: u.Host, Key: strings.TrimPrefix(u.Path, "/")}, true
+}
+
+func (u s3uri) String() string {
+	return "s3://" + u.Bucket + "/" + u.Key
+}
+
+// part is a byte range of a transferred object.
+type part struct {
+	Number int64 // 1-based part number
+	Offset int64
+	Size   int64
+}
+
+func (p part) Range() string {
+	return fmt.Sprintf("bytes=%d-%d", p.Offset, p.Offset+p.Size-1)
+}
+
+func split(n, partSize int64) []part {
+	var parts []part
+	for off, i := int64(0), int64(1); off < n; off, i = off+partSize, i+1 {
+		p := part{Number: i, Offset: off, Size: partSize}
+		if off+p.Size > n {
+			p.Size = n - off
+		}
+		parts = append(parts, p)
+	}
+	return parts
+}
+
+type s3cpCmd struct {
+	PartSize    size
+	Concurrency int
+	Resume      bool
+	Log         *log.Logger
+	flags       *flag.FlagSet
+}
+
+func (cmd *s3cpCmd) Init(flags *flag.FlagSet, log *log.Logger) {
+	cmd.PartSize = 8 << 20
+	flags.Var(&cmd.PartSize, "part-size", "Size of a single part, e.g. 16MiB.")
+	flags.IntVar(&cmd.Concurrency, "concurrency", 4, "Number of parts transferred at once.")
+	flags.BoolVar(&cmd.Resume, "resume", true, "Resume interrupted transfers.")
+	cmd.Log = log
+	cmd.flags = flags
+}
+
+func (cmd *s3cpCmd) Run(session *session.Session) error {
+	if cmd.flags.NArg() != 2 {
+		return errors.New("usage: amz s3cp [flags] SRC DST")
+	}
+	if cmd.PartSize < minPartSize {
+		return fmt.Errorf("part size must be at least %d bytes", minPartSize)
+	}
+	if cmd.Concurrency < 1 {
+		cmd.Concurrency = 1
+	}
+	svc := s3.New(session)
+	src, dst := cmd.flags.Arg(0), cmd.flags.Arg(1)
+	srcURI, srcS3 := parseS3URI(src)
+	dstURI, dstS3 := parseS3URI(dst)
+	switch {
+	case srcS3 && dstS3:
+		if dstURI.Key == "" || strings.HasSuffix(dstURI.Key, "/") {
+			dstURI.Key += path.Base(srcURI.Key)
+		}
+		return cmd.copy(svc, srcURI, dstURI)
+	case srcS3:
+		if fi, err := os.Stat(dst); (err == nil && fi.IsDir()) || strings.HasSuffix(dst, string(os.PathSeparator)) {
+			dst = filepath.Join(dst, path.Base(srcURI.Key))
+		}
+		return cmd.download(svc, srcURI, dst)
+	case dstS3:
+		if dstURI.Key == "" || strings.HasSuffix(dstURI.Key, "/") {
+			dstURI.Key += filepath.Base(src)
+		}
+		return cmd.upload(svc, src, dstURI)
+	default:
+		return errors.New("either SRC or DST must be an s3:// URI")
+	}
+}
+
+// partSize gives the part size for an object of n bytes, raised if needed
+// to fit in the maximum number of parts.
+func (cmd *s3cpCmd) partSize(n int64) int64 {
+	partSize := int64(cmd.PartSize)
+	if min := (n + maxParts - 1) / maxParts; partSize < min {
+		cmd.Log.Printf("raising part size to %d bytes", min)
+		partSize = min
+	}
+	return partSize
+}
+
+// transfer runs fn for each of the parts, which is not done yet, with up to
+// cmd.Concurrency parts at once. It returns the first error.
+func (cmd *s3cpCmd) transfer(name string, parts []part, done map[int64]bool, fn func(part) error) error {
+	bars, err := multibar.New()
+	if err != nil {
+		return err
+	}
+	go bars.Listen()
+	progress := bars.MakeBar(len(parts), name)
+	var (
+		mu    sync.Mutex
+		wg    sync.WaitGroup
+		first error
+		count = len(done)
+		c     = make(chan part)
+	)
+	progress(count)
+	for i := 0; i < cmd.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for p := range c {
+				err := fn(p)
+				mu.Lock()
+				if err != nil && first == nil {
+					first = fmt.Errorf("part %d: %s", p.Number, err)
+				}
+				if err == nil {
+					count++
+					progress(count)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, p := range parts {
+		mu.Lock()
+		failed := first != nil
+		mu.Unlock()
+		if failed {
+			break
+		}
+		if !done[p.Number] {
+			c <- p
+		}
+	}
+	close(c)
+	wg.Wait()
+	return first
+}
+
+// multipart gives the ID of the multipart upload for the object. If cmd.Resume
+// is true and the object has an unfinished upload, which the reuse function
+// accepts, its ID is returned together with its uploaded parts. An upload
+// rejected by reuse is aborted.
+func (cmd *s3cpCmd) multipart(svc *s3.S3, dst s3uri, reuse func(id string) bool) (string, []*s3.Part, error) {
+	if cmd.Resume {
+		var upload *s3.MultipartUpload
+		err := svc.ListMultipartUploadsPages(&s3.ListMultipartUploadsInput{
+			Bucket: aws.String(dst.Bucket),
+			Prefix: aws.String(dst.Key),
+		}, func(resp *s3.ListMultipartUploadsOutput, _ bool) bool {
+			for _, u := range resp.Uploads {
+				if aws.StringValue(u.Key) != dst.Key {
+					continue
+				}
+				if upload == nil || aws.TimeValue(u.Initiated).After(aws.TimeValue(upload.Initiated)) {
+					upload = u
+				}
+			}
+			return true
+		})
+		if err != nil {
+			return "", nil, err
+		}
+		if upload != nil && reuse != nil && !reuse(aws.StringValue(upload.UploadId)) {
+			cmd.Log.Printf("source of %s changed, starting the upload over", dst)
+			_, err := svc.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+				Bucket:   aws.String(dst.Bucket),
+				Key:      aws.String(dst.Key),
+				UploadId: upload.UploadId,
+			})
+			if err != nil {
+				return "", nil, err
+			}
+			upload = nil
+		}
+		if upload != nil {
+			var parts []*s3.Part
+			err := svc.ListPartsPages(&s3.ListPartsInput{
+				Bucket:   aws.String(dst.Bucket),
+				Key:      aws.String(dst.Key),
+				UploadId: upload.UploadId,
+			}, func(resp *s3.ListPartsOutput, _ bool) bool {
+				parts = append(parts, resp.Parts...)
+				return true
+			})
+			if err != nil {
+				return "", nil, err
+			}
+			cmd.Log.Printf("resuming upload of %s with %d parts done", dst, len(parts))
+			return aws.StringValue(upload.UploadId), parts, nil
+		}
+	}
+	resp, err := svc.CreateMultipartUpload(&s3.CreateMultipartUploadInput{
+		Bucket: aws.String(dst.Bucket),
+		Key:    aws.String(dst.Key),
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	return aws.StringValue(resp.UploadId), nil, nil
+}
+
+// complete completes the multipart upload or, if err is not nil and
+// the transfer is not going to be resumed, aborts it.
+func (cmd *s3cpCmd) complete(svc *s3.S3, dst s3uri, id string, etags map[int64]string, err error) error {
+	if err != nil {
+		if cmd.Resume {
+			cmd.Log.Printf("transfer of %s interrupted, run the command again to resume it", dst)
+			return err
+		}
+		_, e := svc.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+			Bucket:   aws.String(dst.Bucket),
+			Key:      aws.String(dst.Key),
+			UploadId: aws.String(id),
+		})
+		return nonil(err, e)
+	}
+	parts := make([]*s3.CompletedPart, 0, len(etags))
+	for n, etag := range etags {
+		parts = append(parts, &s3.CompletedPart{
+			ETag:       aws.String(etag),
+			PartNumber: aws.Int64(n),
+		})
+	}
+	sort.Slice(parts, func(i, j int) bool {
+		return *parts[i].PartNumber < *parts[j].PartNumber
+	})
+	_, err = svc.CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(dst.Bucket),
+		Key:             aws.String(dst.Key),
+		UploadId:        aws.String(id),
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: parts},
+	})
+	return err
+}
+
+func (cmd *s3cpCmd) upload(svc *s3.S3, file string, dst s3uri) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	n := fi.Size()
+	if n <= int64(cmd.PartSize) {
+		_, err := svc.PutObject(&s3.PutObjectInput{
+			Bucket:        aws.String(dst.Bucket),
+			Key:           aws.String(dst.Key),
+			Body:          f,
+			ContentLength: aws.Int64(n),
+		})
+		return err
+	}
+	id, uploaded, err := cmd.multipart(svc, dst, nil)
+	if err != nil {
+		return err
+	}
+	var (
+		parts = split(n, cmd.partSize(n))
+		etags = make(map[int64]string)
+		done  = make(map[int64]bool)
+		mu    sync.Mutex
+	)
+	// A part uploaded before is reused only if its ETag matches MD5
+	// of the local part, as the file may have changed in the meantime.
+	for _, up := range uploaded {
+		i := aws.Int64Value(up.PartNumber) - 1
+		if i < 0 || i >= int64(len(parts)) || aws.Int64Value(up.Size) != parts[i].Size {
+			continue
+		}
+		sum, err := md5sum(io.NewSectionReader(f, parts[i].Offset, parts[i].Size))
+		if err != nil {
+			return err
+		}
+		if etag := aws.StringValue(up.ETag); strings.Trim(etag, `"`) == sum {
+			etags[i+1] = etag
+			done[i+1] = true
+		}
+	}
+	err = cmd.transfer(filepath.Base(file), parts, done, func(p part) error {
+		resp, err := svc.UploadPart(&s3.UploadPartInput{
+			Bucket:        aws.String(dst.Bucket),
+			Key:           aws.String(dst.Key),
+			UploadId:      aws.String(id),
+			PartNumber:    aws.Int64(p.Number),
+			Body:          io.NewSectionReader(f, p.Offset, p.Size),
+			ContentLength: aws.Int64(p.Size),
+		})
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		etags[p.Number] = aws.StringValue(resp.ETag)
+		mu.Unlock()
+		return nil
+	})
+	return cmd.complete(svc, dst, id, etags, err)
+}
+
+func (cmd *s3cpCmd) copy(svc *s3.S3, src, dst s3uri) error {
+	head, err := svc.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(src.Bucket),
+		Key:    aws.String(src.Key),
+	})
+	if err != nil {
+		return err
+	}
+	source := url.PathEscape(src.Bucket) + "/" + escapeKey(src.Key)
+	n := aws.Int64Value(head.ContentLength)
+	if n <= int64(cmd.PartSize) {
+		_, err := svc.CopyObject(&s3.CopyObjectInput{
+			Bucket:     aws.String(dst.Bucket),
+			Key:        aws.String(dst.Key),
+			CopySource: aws.String(source),
+		})
+		return err
+	}
+	// Parts copied before are reused only if the source object did not
+	// change, which is checked with its ETag kept in a state file.
+	etag := aws.StringValue(head.ETag)
+	id, uploaded, err := cmd.multipart(svc, dst, func(id string) bool {
+		var prev copyState
+		p, err := ioutil.ReadFile(copyStateFile(id))
+		if err == nil && json.Unmarshal(p, &prev) == nil && prev.Source == src.String() && prev.ETag == etag {
+			return true
+		}
+		os.Remove(copyStateFile(id))
+		return false
+	})
+	if err != nil {
+		return err
+	}
+	statefile := copyStateFile(id)
+	if cmd.Resume {
+		state, err := json.Marshal(copyState{Source: src.String(), ETag: etag})
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(statefile), 0755); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(statefile, state, 0644); err != nil {
+			return err
+		}
+	}
+	var (
+		parts = split(n, cmd.partSize(n))
+		etags = make(map[int64]string)
+		done  = make(map[int64]bool)
+		mu    sync.Mutex
+	)
+	for _, up := range uploaded {
+		i := aws.Int64Value(up.PartNumber) - 1
+		if i >= 0 && i < int64(len(parts)) && aws.Int64Value(up.Size) == parts[i].Size {
+			etags[i+1] = aws.StringValue(up.ETag)
+			done[i+1] = true
+		}
+	}
+	err = cmd.transfer(path.Base(src.Key), parts, done, func(p part) error {
+		resp, err := svc.UploadPartCopy(&s3.UploadPartCopyInput{
+			Bucket:            aws.String(dst.Bucket),
+			Key:               aws.String(dst.Key),
+			UploadId:          aws.String(id),
+			PartNumber:        aws.Int64(p.Number),
+			CopySource:        aws.String(source),
+			CopySourceRange:   aws.String(p.Range()),
+			CopySourceIfMatch: head.ETag,
+		})
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		etags[p.Number] = aws.StringValue(resp.CopyPartResult.ETag)
+		mu.Unlock()
+		return nil
+	})
+	if err = cmd.complete(svc, dst, id, etags, err); err != nil && cmd.Resume {
+		return err
+	}
+	if e := os.Remove(statefile); e != nil && !os.IsNotExist(e) {
+		return nonil(err, e)
+	}
+	return err
+}
+
+// copyState is the state of an interrupted copy, which is kept in the user's
+// cache directory, as unfinished uploads have no metadata.
+type copyState struct {
+	Source string `json:"source"`
+	ETag   string `json:"etag"`
+}
+
+func copyStateFile(id string) string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, "amz", "s3cp", url.PathEscape(id)+".json")
+}
+
+// download is the state of an interrupted download, which is kept next to
+// the partially written file.
+type download struct {
+	ETag     string  `json:"etag"`
+	Size     int64   `json:"size"`
+	PartSize int64   `json:"part_size"`
+	Done     []int64 `json:"done"`
+}
+
+func (cmd *s3cpCmd) download(svc *s3.S3, src s3uri, file string) error {
+	head, err := svc.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(src.Bucket),
+		Key:    aws.String(src.Key),
+	})
+	if err != nil {
+		return err
+	}
+	n := aws.Int64Value(head.ContentLength)
+	tmp, statefile := file+".part", file+".part.json"
+	cur := download{
+		ETag:     aws.StringValue(head.ETag),
+		Size:     n,
+		PartSize: cmd.partSize(n),
+	}
+	done := make(map[int64]bool)
+	if cmd.Resume {
+		var prev download
+		// The parts done are kept only if the partially written file
+		// is still there, otherwise they would be left zeroed.
+		if p, err := ioutil.ReadFile(statefile); err == nil && json.Unmarshal(p, &prev) == nil &&
+			prev.ETag == cur.ETag && prev.Size == cur.Size && prev.PartSize == cur.PartSize && fileSize(tmp) == n {
+			for _, i := range prev.Done {
+				done[i] = true
+			}
+			cur.Done = prev.Done
+			cmd.Log.Printf("resuming download of %s with %d parts done", src, len(done))
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if err := f.Truncate(n); err != nil {
+		f.Close()
+		return err
+	}
+	var mu sync.Mutex
+	err = cmd.transfer(path.Base(src.Key), split(n, cur.PartSize), done, func(p part) error {
+		resp, err := svc.GetObject(&s3.GetObjectInput{
+			Bucket:  aws.String(src.Bucket),
+			Key:     aws.String(src.Key),
+			Range:   aws.String(p.Range()),
+			IfMatch: head.ETag,
+		})
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		buf := make([]byte, p.Size)
+		if _, err := io.ReadFull(resp.Body, buf); err != nil {
+			return err
+		}
+		if _, err := f.WriteAt(buf, p.Offset); err != nil {
+			return err
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		cur.Done = append(cur.Done, p.Number)
+		if !cmd.Resume {
+			return nil
+		}
+		state, err := json.Marshal(cur)
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(statefile, state, 0644)
+	})
+	if err = nonil(err, f.Sync(), f.Close()); err != nil {
+		if cmd.Resume {
+			cmd.Log.Printf("transfer of %s interrupted, run the command again to resume it", src)
+		} else {
+			os.Remove(tmp)
+		}
+		return err
+	}
+	if err := os.Rename(tmp, file); err != nil {
+		return err
+	}
+	if err := os.Remove(statefile); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// fileSize gives the size of the regular file or -1 if it does not exist.
+func fileSize(file string) int64 {
+	fi, err := os.Stat(file)
+	if err != nil || !fi.Mode().IsRegular() {
+		return -1
+	}
+	return fi.Size()
+}
+
+func md5sum(r io.Reader) (string, error) {
+	h := md5.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// escapeKey escapes the object key for use in a copy source, keeping
+// the slashes.
+func escapeKey(key string) string {
+	elems := strings.Split(key, "/")
+	for i, s := range elems {
+		elems[i] = url.PathEscape(s)
+	}
+	return strings.Join(elems, "/")
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// maxDeleteKeys is the maximum number of keys a single DeleteObjects
+// request can remove.
+const maxDeleteKeys = 1000
+
+type s3rmCmd struct {
+	Path      string
+	Bucket    string
+	Match     globs
+	Older     time.Duration
+	DryRun    bool
+	Force     bool
+	Versions  bool
+	BucketToo bool
+	Log       *log.Logger
+}
+
+func (cmd *s3rmCmd) Init(flags *flag.FlagSet, log *log.Logger) {
+	flags.StringVar(&cmd.Bucket, "bucket", "amz-bucket-"+me.Username, "Bucket name.")
+	flags.StringVar(&cmd.Path, "path", "", "Relative path within bucket.")
+	flags.Var(&cmd.Match, "match", "Delete only keys matching the glob; can be repeated.")
+	flags.DurationVar(&cmd.Older, "older", 0, "Delete only objects older than the duration.")
+	flags.BoolVar(&cmd.DryRun, "dryrun", false, "Print objects to delete, without deleting them.")
+	flags.BoolVar(&cmd.Force, "force", false, "Do not ask for confirmation.")
+	flags.BoolVar(&cmd.Versions, "versions", false, "Delete all versions and delete markers of the objects.")
+	flags.BoolVar(&cmd.BucketToo, "bucket-too", false, "Delete the bucket afterwards.")
+	cmd.Log = log
+}
+
+func (cmd *s3rmCmd) Run(session *session.Session) error {
+	if cmd.BucketToo && (cmd.Path != "" || len(cmd.Match) != 0 || cmd.Older != 0) {
+		return errors.New("-bucket-too cannot be used with -path, -match or -older")
+	}
+	svc := s3.New(session)
+	objs, err := cmd.list(svc)
+	if err != nil {
+		return err
+	}
+	if cmd.DryRun {
+		for _, obj := range objs {
+			fmt.Println(cmd.name(obj))
+		}
+		if cmd.BucketToo {
+			fmt.Println("s3://" + cmd.Bucket)
+		}
+		cmd.Log.Printf("would delete %d objects", len(objs))
+		return nil
+	}
+	if len(objs) == 0 && !cmd.BucketToo {
+		cmd.Log.Printf("no objects to delete")
+		return nil
+	}
+	if !cmd.Force {
+		q := fmt.Sprintf("Delete %d objects from bucket %q", len(objs), cmd.Bucket)
+		if cmd.BucketToo {
+			q += " and the bucket itself"
+		}
+		ok, err := confirm(q + "?")
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return errors.New("aborted")
+		}
+	}
+	var deleted, failed int
+	for len(objs) != 0 {
+		n := len(objs)
+		if n > maxDeleteKeys {
+			n = maxDeleteKeys
+		}
+		resp, err := svc.DeleteObjects(&s3.DeleteObjectsInput{
+			Bucket: aws.String(cmd.Bucket),
+			Delete: &s3.Delete{
+				Objects: objs[:n],
+				Quiet:   aws.Bool(true),
+			},
+		})
+		if err != nil {
+			return err
+		}
+		for _, e := range resp.Errors {
+			cmd.Log.Printf("failed to delete %q: %s", aws.StringValue(e.Key), aws.StringValue(e.Message))
+		}
+		failed += len(resp.Errors)
+		deleted += n - len(resp.Errors)
+		objs = objs[n:]
+		cmd.Log.Printf("deleted=%d, failed=%d", deleted, failed)
+	}
+	if failed != 0 {
+		return fmt.Errorf("failed to delete %d of %d objects", failed, deleted+failed)
+	}
+	if cmd.BucketToo {
+		_, err := svc.DeleteBucket(&s3.DeleteBucketInput{Bucket: aws.String(cmd.Bucket)})
+		if matches(err, "bucketnotempty") && !cmd.Versions {
+			return fmt.Errorf("%s (use -versions for versioned buckets)", err)
+		}
+		return err
+	}
+	return nil
+}
+
+// list gives the objects to delete. With -versions each version and delete
+// marker is a separate object.
+func (cmd *s3rmCmd) list(svc *s3.S3) ([]*s3.ObjectIdentifier, error) {
+	var (
+		objs   []*s3.ObjectIdentifier
+		prefix string
+		oldest = time.Now().Add(-cmd.Older)
+	)
+	if cmd.Path != "" {
+		prefix = cmd.Path + "/"
+	}
+	add := func(key, version *string, modified *time.Time) {
+		rel := strings.TrimPrefix(aws.StringValue(key), prefix)
+		if len(cmd.Match) != 0 && !cmd.Match.match(rel) {
+			return
+		}
+		if cmd.Older != 0 && !aws.TimeValue(modified).Before(oldest) {
+			return
+		}
+		objs = append(objs, &s3.ObjectIdentifier{Key: key, VersionId: version})
+	}
+	if cmd.Versions {
+		params := &s3.ListObjectVersionsInput{
+			Bucket: aws.String(cmd.Bucket),
+			Prefix: aws.String(prefix),
+		}
+		err := svc.ListObjectVersionsPages(params, func(resp *s3.ListObjectVersionsOutput, _ bool) bool {
+			for _, v := range resp.Versions {
+				add(v.Key, v.VersionId, v.LastModified)
+			}
+			for _, m := range resp.DeleteMarkers {
+				add(m.Key, m.VersionId, m.LastModified)
+			}
+			return true
+		})
+		return objs, err
+	}
+	params := &s3.ListObjectsInput{
+		Bucket: aws.String(cmd.Bucket),
+		Prefix: aws.String(prefix),
+	}
+	err := svc.ListObjectsPages(params, func(resp *s3.ListObjectsOutput, _ bool) bool {
+		for _, obj := range resp.Contents {
+			add(obj.Key, nil, obj.LastModified)
+		}
+		return true
+	})
+	return objs, err
+}
+
+func (cmd *s3rmCmd) name(obj *s3.ObjectIdentifier) string {
+	s := s3uri{Bucket: cmd.Bucket, Key: aws.StringValue(obj.Key)}.String()
+	if obj.VersionId != nil {
+		s += " (version " + aws.StringValue(obj.VersionId) + ")"
+	}
+	return s
+}
+
+// confirm asks the question on stderr and reports whether the answer read
+// from stdin was yes. Closed stdin means no.
+func confirm(question string) (bool, error) {
+	fmt.Fprint(os.Stderr, question+" [y/N] ")
+	s, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return false, err
+	}
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "y", "yes":
+		return true, nil
+	default:
+		return false, nil
+	}
+}
@@ -0,0 +1,410 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// globs is a flag value, which collects glob patterns given with
+// a repeated flag.
+type globs []string
+
+func (g *globs) String() string {
+	return strings.Join(*g, ",")
+}
+
+func (g *globs) Set(v string) error {
+	if _, err := path.Match(v, ""); err != nil {
+		return fmt.Errorf("invalid pattern %q", v)
+	}
+	*g = append(*g, v)
+	return nil
+}
+
+// match reports whether any of the patterns matches either the slash-separated
+// path or its base name.
+func (g globs) match(rel string) bool {
+	for _, pattern := range g {
+		if ok, _ := path.Match(pattern, rel); ok {
+			return true
+		}
+		if ok, _ := path.Match(pattern, path.Base(rel)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// syncFile describes either a local file or an object, keyed by its
+// slash-separated path relative to the synced directory or prefix.
+type syncFile struct {
+	Size    int64
+	ModTime time.Time
+	ETag    string // empty for local files
+}
+
+type s3syncCmd struct {
+	Delete  bool
+	DryRun  bool
+	Include globs
+	Exclude globs
+	Log     *log.Logger
+	flags   *flag.FlagSet
+}
+
+func (cmd *s3syncCmd) Init(flags *flag.FlagSet, log *log.Logger) {
+	flags.BoolVar(&cmd.Delete, "delete", false, "Delete files missing in the source.")
+	flags.BoolVar(&cmd.DryRun, "dryrun", false, "Print what would be done, without doing it.")
+	flags.Var(&cmd.Include, "include", "Sync only paths matching the glob; can be repeated.")
+	flags.Var(&cmd.Exclude, "exclude", "Skip paths matching the glob; can be repeated.")
+	cmd.Log = log
+	cmd.flags = flags
+}
+
+func (cmd *s3syncCmd) Run(session *session.Session) error {
+	if cmd.flags.NArg() != 2 {
+		return errors.New("usage: amz s3sync [flags] SRC DST")
+	}
+	src, dst := cmd.flags.Arg(0), cmd.flags.Arg(1)
+	srcURI, srcS3 := parseS3URI(src)
+	dstURI, dstS3 := parseS3URI(dst)
+	switch {
+	case srcS3 && dstS3:
+		return errors.New("syncing between buckets is not supported, use s3cp instead")
+	case srcS3:
+		return cmd.sync(s3.New(session), dst, srcURI, false)
+	case dstS3:
+		return cmd.sync(s3.New(session), src, dstURI, true)
+	default:
+		return errors.New("either SRC or DST must be an s3:// URI")
+	}
+}
+
+// skip reports whether the path is filtered out by the -include and -exclude
+// flags. Skipped paths are neither transferred nor deleted.
+func (cmd *s3syncCmd) skip(rel string) bool {
+	if len(cmd.Include) != 0 && !cmd.Include.match(rel) {
+		return true
+	}
+	return cmd.Exclude.match(rel)
+}
+
+func (cmd *s3syncCmd) sync(svc *s3.S3, dir string, u s3uri, upload bool) error {
+	if u.Key != "" && !strings.HasSuffix(u.Key, "/") {
+		u.Key += "/"
+	}
+	if upload {
+		fi, err := os.Stat(dir)
+		if err != nil {
+			return err
+		}
+		if !fi.IsDir() {
+			return fmt.Errorf("%q is not a directory", dir)
+		}
+	}
+	local, err := cmd.walk(dir)
+	if err != nil {
+		return err
+	}
+	remote, err := cmd.list(svc, u)
+	if err != nil {
+		return err
+	}
+
+	var (
+		jobs   = make(chan func() error, 1024)
+		failed int
+		total  int
+		mu     sync.Mutex
+		wg     sync.WaitGroup
+	)
+
+	for range make([]struct{}, runtime.NumCPU()) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				if err := job(); err != nil {
+					cmd.Log.Print(err)
+					mu.Lock()
+					failed++
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+
+	src, dst := remote, local
+	if upload {
+		src, dst = local, remote
+	}
+	for rel, s := range src {
+		rel, s := rel, s
+		file, safe := localPath(dir, rel)
+		obj := s3uri{Bucket: u.Bucket, Key: u.Key + rel}
+		d, ok := dst[rel]
+		total++
+		jobs <- func() error {
+			if !safe {
+				return fmt.Errorf("%q is outside of %q", rel, dir)
+			}
+			if ok {
+				changed, err := cmd.differs(file, s, d, upload)
+				if err != nil {
+					return fmt.Errorf("failed to compare %q: %s", file, err)
+				}
+				if !changed {
+					return nil
+				}
+			}
+			if upload {
+				return cmd.upload(svc, file, obj)
+			}
+			return cmd.download(svc, obj, file, s.ModTime)
+		}
+	}
+	if cmd.Delete {
+		for rel := range dst {
+			if _, ok := src[rel]; ok {
+				continue
+			}
+			rel := rel
+			total++
+			jobs <- func() error {
+				if upload {
+					return cmd.remove(svc, s3uri{Bucket: u.Bucket, Key: u.Key + rel})
+				}
+				file, ok := localPath(dir, rel)
+				if !ok {
+					return fmt.Errorf("%q is outside of %q", rel, dir)
+				}
+				return cmd.removeFile(file)
+			}
+		}
+	}
+
+	close(jobs)
+
+	wg.Wait()
+
+	if failed != 0 {
+		return fmt.Errorf("%d of %d files failed to sync", failed, total)
+	}
+	return nil
+}
+
+// differs reports whether the source file s needs to be transferred over
+// the destination file d. Files of the same size are compared by MD5 sum
+// of the local file and ETag of the object; for objects uploaded with
+// multipart, whose ETag is not an MD5 sum, the newer file wins.
+func (cmd *s3syncCmd) differs(file string, s, d syncFile, upload bool) (bool, error) {
+	if s.Size != d.Size {
+		return true, nil
+	}
+	etag := s.ETag
+	if upload {
+		etag = d.ETag
+	}
+	etag = strings.Trim(etag, `"`)
+	if !strings.Contains(etag, "-") {
+		f, err := os.Open(file)
+		if err != nil {
+			return false, err
+		}
+		defer f.Close()
+		sum, err := md5sum(f)
+		if err != nil {
+			return false, err
+		}
+		return sum != etag, nil
+	}
+	return s.ModTime.After(d.ModTime), nil
+}
+
+// walk gives the regular files under the directory. A missing directory
+// is treated as an empty one, as it is created by a download.
+func (cmd *s3syncCmd) walk(dir string) (map[string]syncFile, error) {
+	files := make(map[string]syncFile)
+	err := filepath.Walk(dir, func(file string, fi os.FileInfo, err error) error {
+		if os.IsNotExist(err) && file == dir {
+			return filepath.SkipDir
+		}
+		if err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, file)
+		if err != nil {
+			return err
+		}
+		if rel = filepath.ToSlash(rel); !cmd.skip(rel) {
+			files[rel] = syncFile{Size: fi.Size(), ModTime: fi.ModTime()}
+		}
+		return nil
+	})
+	return files, err
+}
+
+// localPath gives the path of the file for the slash-separated path relative
+// to the directory. It reports false if the file would be outside of it.
+func localPath(dir, rel string) (string, bool) {
+	file := filepath.Join(dir, filepath.FromSlash(rel))
+	r, err := filepath.Rel(dir, file)
+	if err != nil || r == ".." || strings.HasPrefix(r, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return file, true
+}
+
+// list gives the objects under the prefix, skipping directory placeholders.
+// Objects, whose keys are not clean relative paths, like "a/../../b", are
+// skipped as well, as they could be downloaded outside of the directory.
+func (cmd *s3syncCmd) list(svc *s3.S3, u s3uri) (map[string]syncFile, error) {
+	objs := make(map[string]syncFile)
+	params := &s3.ListObjectsInput{
+		Bucket: aws.String(u.Bucket),
+	}
+	if u.Key != "" {
+		params.Prefix = aws.String(u.Key)
+	}
+	err := svc.ListObjectsPages(params, func(resp *s3.ListObjectsOutput, _ bool) bool {
+		for _, obj := range resp.Contents {
+			rel := strings.TrimPrefix(aws.StringValue(obj.Key), u.Key)
+			if rel == "" || strings.HasSuffix(rel, "/") || cmd.skip(rel) {
+				continue
+			}
+			if path.IsAbs(rel) || path.Clean(rel) != rel || rel == ".." || strings.HasPrefix(rel, "../") {
+				cmd.Log.Printf("skipping %s: invalid local path", s3uri{Bucket: u.Bucket, Key: u.Key + rel})
+				continue
+			}
+			objs[rel] = syncFile{
+				Size:    aws.Int64Value(obj.Size),
+				ModTime: aws.TimeValue(obj.LastModified),
+				ETag:    aws.StringValue(obj.ETag),
+			}
+		}
+		return true
+	})
+	return objs, err
+}
+
+func (cmd *s3syncCmd) upload(svc *s3.S3, file string, dst s3uri) error {
+	cmd.Log.Printf("%supload %s to %s", cmd.prefix(), file, dst)
+	if cmd.DryRun {
+		return nil
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return fmt.Errorf("failed to upload %q: %s", file, err)
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to upload %q: %s", file, err)
+	}
+	_, err = svc.PutObject(&s3.PutObjectInput{
+		Bucket:        aws.String(dst.Bucket),
+		Key:           aws.String(dst.Key),
+		Body:          f,
+		ContentLength: aws.Int64(fi.Size()),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to upload %q: %s", file, err)
+	}
+	return nil
+}
+
+// download writes the object to a temporary file first, so an interrupted
+// sync does not leave truncated files behind. The modification time of
+// the file is set to the one of the object.
+func (cmd *s3syncCmd) download(svc *s3.S3, src s3uri, file string, modTime time.Time) error {
+	cmd.Log.Printf("%sdownload %s to %s", cmd.prefix(), src, file)
+	if cmd.DryRun {
+		return nil
+	}
+	resp, err := svc.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(src.Bucket),
+		Key:    aws.String(src.Key),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to download %q: %s", src, err)
+	}
+	defer resp.Body.Close()
+
+	dir := filepath.Dir(file)
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create %q: %s", dir, err)
+	}
+
+	f, err := ioutil.TempFile(dir, "."+filepath.Base(file))
+	if err != nil {
+		return fmt.Errorf("failed to create %q: %s", file, err)
+	}
+
+	if _, err := io.Copy(f, resp.Body); err != nil {
+		nonil(f.Close(), os.Remove(f.Name()))
+		return fmt.Errorf("failed to write %q: %s", file, err)
+	}
+
+	if err := nonil(f.Sync(), f.Close(), os.Chmod(f.Name(), 0644), os.Chtimes(f.Name(), modTime, modTime)); err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("failed to close %q: %s", file, err)
+	}
+
+	if err := os.Rename(f.Name(), file); err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("failed to rename %q: %s", file, err)
+	}
+	return nil
+}
+
+func (cmd *s3syncCmd) remove(svc *s3.S3, obj s3uri) error {
+	cmd.Log.Printf("%sdelete %s", cmd.prefix(), obj)
+	if cmd.DryRun {
+		return nil
+	}
+	_, err := svc.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(obj.Bucket),
+		Key:    aws.String(obj.Key),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete %q: %s", obj, err)
+	}
+	return nil
+}
+
+func (cmd *s3syncCmd) removeFile(file string) error {
+	cmd.Log.Printf("%sdelete %s", cmd.prefix(), file)
+	if cmd.DryRun {
+		return nil
+	}
+	if err := os.Remove(file); err != nil {
+		return fmt.Errorf("failed to delete %q: %s", file, err)
+	}
+	return nil
+}
+
+func (cmd *s3syncCmd) prefix() string {
+	if cmd.DryRun {
+		return "(dryrun) "
+	}
+	return ""
+}
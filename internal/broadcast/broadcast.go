@@ -0,0 +1,294 @@
+// Package broadcast implements an HTTP server, which streams messages to its
+// clients with Server-Sent Events and WebSocket.
+package broadcast
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rjeczalik/cmd/internal/netz"
+)
+
+// Message is a single message being broadcast. The Path and Kinds fields
+// are used for filtering, the Data field is sent to the clients.
+type Message struct {
+	Path  string
+	Kinds []string
+	Data  []byte
+}
+
+// Status is the value served by the /status endpoint.
+type Status struct {
+	Started  time.Time `json:"started"`
+	Uptime   string    `json:"uptime"`
+	Messages uint64    `json:"messages"`
+	Sent     uint64    `json:"sent"`
+	Dropped  uint64    `json:"dropped"`
+	Clients  int       `json:"clients"`
+	SSE      int       `json:"sse"`
+	WS       int       `json:"websocket"`
+}
+
+// Server is an HTTP server, which serves the following endpoints:
+//
+//	/events  - Server-Sent Events stream of the messages
+//	/ws      - WebSocket stream of the messages, each in a text frame
+//	/status  - JSON object with the server counters
+//
+// Both streams accept the path and kind query parameters, which limit
+// the messages sent to the client. The path parameter is a glob pattern
+// or a path prefix; the kind parameter is a comma-separated list of kinds.
+// Both of them can be repeated.
+type Server struct {
+	// Network is used to listen for connections. If nil, netz.Default is used.
+	Network netz.Network
+	// Buffer is the number of messages queued for each client. Messages sent
+	// to a client with a full queue are dropped. If 0, 64 is used.
+	Buffer int
+
+	once     sync.Once
+	srv      http.Server
+	mu       sync.Mutex
+	clients  map[*client]struct{}
+	started  time.Time
+	messages uint64
+	sent     uint64
+	dropped  uint64
+}
+
+var _ http.Handler = (*Server)(nil)
+
+type client struct {
+	c      chan []byte
+	done   chan struct{}
+	filter filter
+	ws     bool
+}
+
+func (s *Server) init() {
+	s.once.Do(func() {
+		s.srv.Handler = s
+		s.clients = make(map[*client]struct{})
+		s.started = time.Now()
+	})
+}
+
+func (s *Server) network() netz.Network {
+	if s.Network != nil {
+		return s.Network
+	}
+	return netz.Default
+}
+
+// Listen announces the address on the given network.
+func (s *Server) Listen(network, addr string) (net.Listener, error) {
+	return s.network().Listen(network, addr)
+}
+
+// Serve serves HTTP requests accepted on the listener. It returns after
+// the listener was closed.
+func (s *Server) Serve(l net.Listener) error {
+	s.init()
+	return s.srv.Serve(l)
+}
+
+// ListenAndServe listens on the TCP address and serves HTTP requests.
+func (s *Server) ListenAndServe(addr string) error {
+	l, err := s.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Send broadcasts the message to all the clients whose filters match it.
+func (s *Server) Send(m Message) {
+	s.init()
+	atomic.AddUint64(&s.messages, 1)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for c := range s.clients {
+		if !c.filter.match(m) {
+			continue
+		}
+		select {
+		case c.c <- m.Data:
+			atomic.AddUint64(&s.sent, 1)
+		default:
+			atomic.AddUint64(&s.dropped, 1)
+		}
+	}
+}
+
+// Close closes the listeners being served and disconnects all the clients.
+func (s *Server) Close() error {
+	s.init()
+	err := s.srv.Close()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for c := range s.clients {
+		close(c.done)
+		delete(s.clients, c)
+	}
+	return err
+}
+
+// Status gives the current values of the server counters.
+func (s *Server) Status() Status {
+	s.init()
+	st := Status{
+		Started:  s.started,
+		Uptime:   time.Since(s.started).Round(time.Second).String(),
+		Messages: atomic.LoadUint64(&s.messages),
+		Sent:     atomic.LoadUint64(&s.sent),
+		Dropped:  atomic.LoadUint64(&s.dropped),
+	}
+	s.mu.Lock()
+	for c := range s.clients {
+		if c.ws {
+			st.WS++
+		} else {
+			st.SSE++
+		}
+	}
+	s.mu.Unlock()
+	st.Clients = st.SSE + st.WS
+	return st
+}
+
+// ServeHTTP implements the http.Handler interface.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.init()
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	switch r.URL.Path {
+	case "/events":
+		s.serveSSE(w, r)
+	case "/ws":
+		s.serveWS(w, r)
+	case "/status":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.Status())
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *Server) register(r *http.Request, ws bool) *client {
+	n := s.Buffer
+	if n <= 0 {
+		n = 64
+	}
+	c := &client{
+		c:      make(chan []byte, n),
+		done:   make(chan struct{}),
+		filter: newFilter(r),
+		ws:     ws,
+	}
+	s.mu.Lock()
+	s.clients[c] = struct{}{}
+	s.mu.Unlock()
+	return c
+}
+
+func (s *Server) unregister(c *client) {
+	s.mu.Lock()
+	if _, ok := s.clients[c]; ok {
+		close(c.done)
+		delete(s.clients, c)
+	}
+	s.mu.Unlock()
+}
+
+func (s *Server) serveSSE(w http.ResponseWriter, r *http.Request) {
+	f, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	c := s.register(r, false)
+	defer s.unregister(c)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	f.Flush()
+	for {
+		select {
+		case p := <-c.c:
+			if _, err := fmt.Fprintf(w, "data: %s\n\n", p); err != nil {
+				return
+			}
+			f.Flush()
+		case <-c.done:
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// filter selects messages sent to a client.
+type filter struct {
+	paths []string
+	kinds []string
+}
+
+func newFilter(r *http.Request) filter {
+	var f filter
+	q := r.URL.Query()
+	f.paths = q["path"]
+	for _, v := range q["kind"] {
+		for _, kind := range strings.Split(v, ",") {
+			if kind = strings.TrimSpace(kind); kind != "" {
+				f.kinds = append(f.kinds, strings.ToLower(kind))
+			}
+		}
+	}
+	return f
+}
+
+func (f filter) match(m Message) bool {
+	return f.matchPath(m.Path) && f.matchKind(m.Kinds)
+}
+
+func (f filter) matchPath(path string) bool {
+	if len(f.paths) == 0 {
+		return true
+	}
+	for _, p := range f.paths {
+		if strings.HasPrefix(path, p) {
+			return true
+		}
+		if ok, _ := filepath.Match(p, path); ok {
+			return true
+		}
+		if ok, _ := filepath.Match(p, filepath.Base(path)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (f filter) matchKind(kinds []string) bool {
+	if len(f.kinds) == 0 {
+		return true
+	}
+	for _, k := range f.kinds {
+		for _, kind := range kinds {
+			if k == strings.ToLower(kind) {
+				return true
+			}
+		}
+	}
+	return false
+}
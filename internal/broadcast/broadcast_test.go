@@ -0,0 +1,198 @@
+package broadcast
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rjeczalik/cmd/internal/netz/memnetz"
+)
+
+func newServer(t *testing.T) (*Server, *http.Client, string) {
+	s := &Server{Network: memnetz.NewNet()}
+	l, err := s.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen()=%v", err)
+	}
+	go s.Serve(l)
+	c := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(_ context.Context, network, addr string) (net.Conn, error) {
+				return s.Network.Dial(network, addr)
+			},
+		},
+	}
+	return s, c, l.Addr().String()
+}
+
+func waitClients(t *testing.T, s *Server, n int) {
+	for i := 0; i < 100; i++ {
+		if s.Status().Clients == n {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("want clients=%d; got %d", n, s.Status().Clients)
+}
+
+var messages = []Message{
+	0: {Path: "/tmp/a.go", Kinds: []string{"create"}, Data: []byte(`{"path":"/tmp/a.go"}`)},
+	1: {Path: "/tmp/b.txt", Kinds: []string{"write"}, Data: []byte(`{"path":"/tmp/b.txt"}`)},
+	2: {Path: "/var/c.go", Kinds: []string{"write"}, Data: []byte(`{"path":"/var/c.go"}`)},
+	3: {Path: "/tmp/d.go", Kinds: []string{"create", "write"}, Data: []byte(`{"path":"/tmp/d.go"}`)},
+}
+
+func TestFilter(t *testing.T) {
+	cases := [...]struct {
+		query string
+		match []int
+	}{
+		0: {"", []int{0, 1, 2, 3}},
+		1: {"path=/tmp", []int{0, 1, 3}},
+		2: {"path=*.go", []int{0, 2, 3}},
+		3: {"kind=write", []int{1, 2, 3}},
+		4: {"kind=Create,remove", []int{0, 3}},
+		5: {"path=/tmp&kind=write", []int{1, 3}},
+		6: {"path=/var&path=*.txt", []int{1, 2}},
+		7: {"path=/usr", nil},
+	}
+	for i, cas := range cases {
+		r, err := http.NewRequest("GET", "/events?"+cas.query, nil)
+		if err != nil {
+			t.Fatalf("NewRequest()=%v (i=%d)", err, i)
+		}
+		f := newFilter(r)
+		var match []int
+		for j, m := range messages {
+			if f.match(m) {
+				match = append(match, j)
+			}
+		}
+		if len(match) != len(cas.match) {
+			t.Errorf("want match=%v; got %v (i=%d)", cas.match, match, i)
+			continue
+		}
+		for j := range match {
+			if match[j] != cas.match[j] {
+				t.Errorf("want match=%v; got %v (i=%d)", cas.match, match, i)
+				break
+			}
+		}
+	}
+}
+
+func TestSSE(t *testing.T) {
+	s, c, addr := newServer(t)
+	defer s.Close()
+	resp, err := c.Get("http://" + addr + "/events?kind=write")
+	if err != nil {
+		t.Fatalf("Get()=%v", err)
+	}
+	defer resp.Body.Close()
+	if typ := resp.Header.Get("Content-Type"); typ != "text/event-stream" {
+		t.Fatalf("want Content-Type=text/event-stream; got %q", typ)
+	}
+	waitClients(t, s, 1)
+	for _, m := range messages {
+		s.Send(m)
+	}
+	r := bufio.NewReader(resp.Body)
+	for _, i := range []int{1, 2, 3} {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("ReadString()=%v", err)
+		}
+		if want := "data: " + string(messages[i].Data) + "\n"; line != want {
+			t.Errorf("want line=%q; got %q", want, line)
+		}
+		if line, _ = r.ReadString('\n'); line != "\n" {
+			t.Errorf("want empty line; got %q", line)
+		}
+	}
+}
+
+func TestWebSocket(t *testing.T) {
+	s, _, addr := newServer(t)
+	defer s.Close()
+	conn, err := s.Network.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Dial()=%v", err)
+	}
+	defer conn.Close()
+	const key = "dGhlIHNhbXBsZSBub25jZQ=="
+	req := "GET /ws?path=*.go HTTP/1.1\r\nHost: " + addr + "\r\n" +
+		"Upgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: " + key + "\r\nSec-WebSocket-Version: 13\r\n\r\n"
+	if _, err := conn.Write([]byte(req)); err != nil {
+		t.Fatalf("Write()=%v", err)
+	}
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatalf("ReadResponse()=%v", err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("want StatusCode=101; got %d", resp.StatusCode)
+	}
+	if accept := resp.Header.Get("Sec-WebSocket-Accept"); accept != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("want Sec-WebSocket-Accept=s3pPLMBiTxaQ9kYGzzhZRbK+xOo=; got %q", accept)
+	}
+	waitClients(t, s, 1)
+	for _, m := range messages {
+		s.Send(m)
+	}
+	for _, i := range []int{0, 2, 3} {
+		op, p, err := readFrame(r)
+		if err != nil {
+			t.Fatalf("readFrame()=%v", err)
+		}
+		if op != opText {
+			t.Errorf("want op=%d; got %d", opText, op)
+		}
+		if string(p) != string(messages[i].Data) {
+			t.Errorf("want payload=%s; got %s", messages[i].Data, p)
+		}
+	}
+	// Masked close frame, as sent by a client.
+	if _, err := conn.Write([]byte{0x80 | opClose, 0x80, 1, 2, 3, 4}); err != nil {
+		t.Fatalf("Write()=%v", err)
+	}
+	if op, _, err := readFrame(r); err != nil || op != opClose {
+		t.Fatalf("want op=%d; got %d (err=%v)", opClose, op, err)
+	}
+	waitClients(t, s, 0)
+}
+
+func TestStatus(t *testing.T) {
+	s, c, addr := newServer(t)
+	defer s.Close()
+	resp, err := c.Get("http://" + addr + "/events?path=/var")
+	if err != nil {
+		t.Fatalf("Get()=%v", err)
+	}
+	defer resp.Body.Close()
+	waitClients(t, s, 1)
+	for _, m := range messages {
+		s.Send(m)
+	}
+	resp, err = c.Get("http://" + addr + "/status")
+	if err != nil {
+		t.Fatalf("Get()=%v", err)
+	}
+	defer resp.Body.Close()
+	var st Status
+	if err := json.NewDecoder(resp.Body).Decode(&st); err != nil {
+		t.Fatalf("Decode()=%v", err)
+	}
+	if st.Messages != 4 || st.Sent != 1 || st.Clients != 1 || st.SSE != 1 || st.WS != 0 {
+		t.Errorf("unexpected status: %+v", st)
+	}
+	if !strings.HasSuffix(st.Uptime, "s") {
+		t.Errorf("want uptime in seconds; got %q", st.Uptime)
+	}
+}
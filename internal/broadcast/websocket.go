@@ -0,0 +1,186 @@
+package broadcast
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// wsGUID is the key suffix defined by RFC 6455, section 1.3.
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+const (
+	opText  = 0x1
+	opClose = 0x8
+	opPing  = 0x9
+	opPong  = 0xA
+)
+
+var errFrame = errors.New("broadcast: invalid websocket frame")
+
+func wsAccept(key string) string {
+	h := sha1.New()
+	io.WriteString(h, key+wsGUID)
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+func headerContains(h http.Header, name, value string) bool {
+	for _, v := range h[http.CanonicalHeaderKey(name)] {
+		for _, s := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(s), value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (s *Server) serveWS(w http.ResponseWriter, r *http.Request) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if !headerContains(r.Header, "Connection", "upgrade") ||
+		!headerContains(r.Header, "Upgrade", "websocket") || key == "" {
+		http.Error(w, "websocket upgrade required", http.StatusBadRequest)
+		return
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "websocket not supported", http.StatusInternalServerError)
+		return
+	}
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + wsAccept(key) + "\r\n\r\n")
+	if err := rw.Flush(); err != nil {
+		return
+	}
+	c := s.register(r, true)
+	defer s.unregister(c)
+	ctrl := make(chan frame, 1)
+	go func() {
+		defer s.unregister(c)
+		readFrames(rw.Reader, ctrl, c.done)
+	}()
+	for {
+		select {
+		case p := <-c.c:
+			if err := writeFrame(conn, opText, p); err != nil {
+				return
+			}
+		case f := <-ctrl:
+			if err := writeFrame(conn, f.op, f.payload); err != nil || f.op == opClose {
+				return
+			}
+		case <-c.done:
+			writeFrame(conn, opClose, nil)
+			return
+		}
+	}
+}
+
+type frame struct {
+	op      byte
+	payload []byte
+}
+
+// readFrames reads frames sent by the client, discarding data frames and
+// sending replies for control frames to the ctrl channel. It returns after
+// the client closed the connection or sent a close frame.
+func readFrames(r *bufio.Reader, ctrl chan<- frame, done <-chan struct{}) {
+	for {
+		op, payload, err := readFrame(r)
+		if err != nil {
+			return
+		}
+		var reply frame
+		switch op {
+		case opPing:
+			reply = frame{opPong, payload}
+		case opClose:
+			reply = frame{opClose, payload}
+		default:
+			continue
+		}
+		select {
+		case ctrl <- reply:
+		case <-done:
+			return
+		}
+		if op == opClose {
+			return
+		}
+	}
+}
+
+func readFrame(r *bufio.Reader) (byte, []byte, error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return 0, nil, err
+	}
+	op := hdr[0] & 0x0F
+	masked := hdr[1]&0x80 != 0
+	n := uint64(hdr[1] & 0x7F)
+	switch n {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		n = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		n = binary.BigEndian.Uint64(ext[:])
+	}
+	if n > 1<<20 {
+		return 0, nil, errFrame
+	}
+	var mask [4]byte
+	if masked {
+		if _, err := io.ReadFull(r, mask[:]); err != nil {
+			return 0, nil, err
+		}
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+	return op, payload, nil
+}
+
+// writeFrame writes a single unmasked frame, as sent by the server.
+func writeFrame(conn net.Conn, op byte, payload []byte) error {
+	hdr := []byte{0x80 | op, 0}
+	switch n := len(payload); {
+	case n < 126:
+		hdr[1] = byte(n)
+	case n <= 0xFFFF:
+		hdr[1] = 126
+		hdr = append(hdr, byte(n>>8), byte(n))
+	default:
+		hdr[1] = 127
+		var ext [8]byte
+		binary.BigEndian.PutUint64(ext[:], uint64(n))
+		hdr = append(hdr, ext[:]...)
+	}
+	_, err := conn.Write(append(hdr, payload...))
+	return err
+}
@@ -0,0 +1,157 @@
+// Package ignore implements matching paths against patterns read from
+// files using the gitignore syntax.
+package ignore
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+)
+
+type rule struct {
+	re      *regexp.Regexp
+	negate  bool
+	dirOnly bool
+}
+
+// Rules is a list of patterns, which is evaluated in order. The last
+// matching pattern decides whether path is ignored or not.
+type Rules struct {
+	rules []rule
+}
+
+// Parse reads patterns from r, one pattern per line.
+//
+// Blank lines and lines starting with # are skipped. A pattern prefixed
+// with ! negates the match, a pattern with trailing slash matches only
+// directories. A pattern which does not contain a slash matches a name
+// at any directory level, otherwise it is matched against a path relative
+// to the ignore file's directory. The * and ? wildcards do not match
+// a slash, ** matches any number of directories.
+func Parse(r io.Reader) (*Rules, error) {
+	var rules Rules
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), " \t\r")
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		var ru rule
+		switch {
+		case line[0] == '!':
+			ru.negate, line = true, line[1:]
+		case strings.HasPrefix(line, `\!`), strings.HasPrefix(line, `\#`):
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			ru.dirOnly, line = true, strings.TrimRight(line, "/")
+		}
+		if line == "" {
+			continue
+		}
+		anchored := strings.Contains(line, "/")
+		re, err := compile(strings.TrimPrefix(line, "/"), anchored)
+		if err != nil {
+			return nil, err
+		}
+		ru.re = re
+		rules.rules = append(rules.rules, ru)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return &rules, nil
+}
+
+// ParseFile reads patterns from the given file.
+func ParseFile(file string) (*Rules, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return Parse(f)
+}
+
+// Match reports whether the slash-separated path, relative to the ignore
+// file's directory, is ignored. The isDir argument tells whether the path
+// points to a directory.
+//
+// As with git, a path which is inside ignored directory is ignored as well,
+// even if it matches a negated pattern.
+func (r *Rules) Match(p string, isDir bool) bool {
+	p = strings.Trim(path.Clean(p), "/")
+	if p == "." || p == "" {
+		return false
+	}
+	for i := 0; i < len(p); i++ {
+		if p[i] == '/' && r.match(p[:i], true) {
+			return true
+		}
+	}
+	return r.match(p, isDir)
+}
+
+func (r *Rules) match(p string, isDir bool) bool {
+	ignored := false
+	for _, ru := range r.rules {
+		if ru.dirOnly && !isDir {
+			continue
+		}
+		if ru.re.MatchString(p) {
+			ignored = !ru.negate
+		}
+	}
+	return ignored
+}
+
+// compile translates the pattern into a regular expression.
+func compile(pattern string, anchored bool) (*regexp.Regexp, error) {
+	var buf strings.Builder
+	buf.WriteString("^")
+	if !anchored {
+		buf.WriteString("(?:.*/)?")
+	}
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; c {
+		case '*':
+			if i+1 < len(pattern) && pattern[i+1] == '*' {
+				i++
+				if i+1 < len(pattern) && pattern[i+1] == '/' {
+					i++
+					buf.WriteString("(?:.*/)?")
+				} else {
+					buf.WriteString(".*")
+				}
+			} else {
+				buf.WriteString("[^/]*")
+			}
+		case '?':
+			buf.WriteString("[^/]")
+		case '[':
+			j := strings.IndexByte(pattern[i+1:], ']')
+			if j == -1 {
+				buf.WriteString(`\[`)
+				continue
+			}
+			class := pattern[i+1 : i+1+j]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			buf.WriteString("[" + strings.Replace(class, `\`, `\\`, -1) + "]")
+			i += j + 1
+		case '\\':
+			if i+1 < len(pattern) {
+				i++
+				buf.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+			}
+		default:
+			buf.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	buf.WriteString("$")
+	return regexp.Compile(buf.String())
+}
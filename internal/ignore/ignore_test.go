@@ -0,0 +1,57 @@
+package ignore
+
+import (
+	"strings"
+	"testing"
+)
+
+const rules = `# comment
+*.o
+/build
+docs/**/*.html
+node_modules/
+!keep.o
+vendor/
+!vendor/keep
+\#hash
+a?c
+[xy].tmp
+`
+
+func TestMatch(t *testing.T) {
+	r, err := Parse(strings.NewReader(rules))
+	if err != nil {
+		t.Fatalf("Parse()=%v", err)
+	}
+	cases := [...]struct {
+		path    string
+		isDir   bool
+		ignored bool
+	}{
+		0:  {"main.o", false, true},
+		1:  {"pkg/sub/main.o", false, true},
+		2:  {"keep.o", false, false},
+		3:  {"build", true, true},
+		4:  {"build/out.bin", false, true},
+		5:  {"src/build", true, false},
+		6:  {"docs/index.html", false, true},
+		7:  {"docs/a/b/index.html", false, true},
+		8:  {"site/docs/index.html", false, false},
+		9:  {"node_modules", false, false},
+		10: {"node_modules", true, true},
+		11: {"web/node_modules/x/index.js", false, true},
+		12: {"vendor/keep", false, true},
+		13: {"#hash", false, true},
+		14: {"abc", false, true},
+		15: {"a/c", false, false},
+		16: {"x.tmp", false, true},
+		17: {"z.tmp", false, false},
+		18: {"main.go", false, false},
+		19: {".", true, false},
+	}
+	for i, cas := range cases {
+		if ignored := r.Match(cas.path, cas.isDir); ignored != cas.ignored {
+			t.Errorf("want ignored=%t; got %t (i=%d)", cas.ignored, ignored, i)
+		}
+	}
+}
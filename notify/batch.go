@@ -0,0 +1,83 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// Batch is passed to the template of a handler run with the -batch flag.
+// The embedded Event is the last event of the batch.
+type Batch struct {
+	Event
+	Events []Event  // events received within the window
+	Paths  []string // unique paths of the events, in order of their events
+}
+
+func newBatch(e Event) Batch {
+	b := Batch{Event: e, Events: e.batch}
+	seen := make(map[string]struct{})
+	for _, e := range e.batch {
+		if _, ok := seen[e.Path]; ok {
+			continue
+		}
+		seen[e.Path] = struct{}{}
+		b.Paths = append(b.Paths, e.Path)
+	}
+	return b
+}
+
+func setBatch(o *handlerOptions, s string) error {
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	o.Batch = d
+	return nil
+}
+
+// batcher collects events received within a window, which starts with
+// the first event, and pushes them to the queue as a single event.
+type batcher struct {
+	mu     sync.Mutex
+	window time.Duration
+	queue  *queue
+	events []Event
+	timer  *time.Timer
+}
+
+func newBatcher(window time.Duration, q *queue) *batcher {
+	return &batcher{window: window, queue: q}
+}
+
+// Add adds the event to the current batch.
+func (b *batcher) Add(e Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.events = append(b.events, e)
+	if b.timer == nil {
+		b.timer = time.AfterFunc(b.window, b.Flush)
+	}
+}
+
+// Flush pushes the current batch to the queue.
+func (b *batcher) Flush() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	if len(b.events) == 0 {
+		return
+	}
+	e := b.events[len(b.events)-1]
+	e.batch = b.events
+	for _, ev := range b.events {
+		e.keep = e.keep || ev.keep
+	}
+	b.events = nil
+	if !b.queue.Push(e) {
+		log.Println("batch dropped due to slow handler")
+	}
+}
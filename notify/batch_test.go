@@ -0,0 +1,132 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNewBatch(t *testing.T) {
+	cases := [...]struct {
+		paths []string
+		uniq  []string
+	}{
+		0: {[]string{"a"}, []string{"a"}},
+		1: {[]string{"a", "b", "c"}, []string{"a", "b", "c"}},
+		2: {[]string{"a", "a", "a"}, []string{"a"}},
+		3: {[]string{"b", "a", "b", "c", "a"}, []string{"b", "a", "c"}},
+	}
+	for i, cas := range cases {
+		events := make([]Event, len(cas.paths))
+		for j, path := range cas.paths {
+			events[j] = ev(path, uint64(j+1))
+		}
+		e := events[len(events)-1]
+		e.batch = events
+		b := newBatch(e)
+		if !equal(b.Paths, cas.uniq) {
+			t.Errorf("want Paths=%v; got %v (i=%d)", cas.uniq, b.Paths, i)
+		}
+		if len(b.Events) != len(events) {
+			t.Errorf("want len(Events)=%d; got %d (i=%d)", len(events), len(b.Events), i)
+		}
+		if want := name(events[len(events)-1]); name(b.Event) != want {
+			t.Errorf("want Event=%s; got %s (i=%d)", want, name(b.Event), i)
+		}
+	}
+}
+
+// batches pops the queued batches, giving names of their events.
+func batches(q *queue) [][]string {
+	q.Close()
+	var names [][]string
+	for {
+		e, ok := q.Pop()
+		if !ok {
+			return names
+		}
+		q.Done(e)
+		var batch []string
+		for _, e := range e.batch {
+			batch = append(batch, name(e))
+		}
+		names = append(names, batch)
+	}
+}
+
+func TestBatcher(t *testing.T) {
+	const window = 50 * time.Millisecond
+	cases := [...]struct {
+		paths   []string
+		pause   int // index of the event added after the window passed, or -1
+		batches [][]string
+	}{
+		0: {[]string{"a", "b", "a"}, -1, [][]string{{"a1", "b2", "a3"}}},
+		1: {[]string{"a", "b", "c"}, 2, [][]string{{"a1", "b2"}, {"c3"}}},
+		2: {[]string{"a", "b", "c"}, 1, [][]string{{"a1"}, {"b2", "c3"}}},
+	}
+	for i, cas := range cases {
+		q := newQueue(policyUnbounded, 0)
+		b := newBatcher(window, q)
+		for j, path := range cas.paths {
+			if j == cas.pause {
+				time.Sleep(4 * window)
+			}
+			b.Add(ev(path, uint64(j+1)))
+		}
+		time.Sleep(4 * window)
+		got := batches(q)
+		if len(got) != len(cas.batches) {
+			t.Errorf("want batches=%v; got %v (i=%d)", cas.batches, got, i)
+			continue
+		}
+		for j := range got {
+			if !equal(got[j], cas.batches[j]) {
+				t.Errorf("want batches=%v; got %v (i=%d)", cas.batches, got, i)
+				break
+			}
+		}
+	}
+}
+
+func TestBatcherFlush(t *testing.T) {
+	q := newQueue(policyUnbounded, 0)
+	h := &handler{queue: q, batch: newBatcher(time.Hour, q)}
+	h.Send(ev("a", 1))
+	h.Send(ev("b", 2))
+	if n := q.Len(); n != 0 {
+		t.Fatalf("want no events queued within the window; got %d", n)
+	}
+	h.Close()
+	got := batches(q)
+	if len(got) != 1 || !equal(got[0], []string{"a1", "b2"}) {
+		t.Fatalf("want batches=[[a1 b2]] after Close; got %v", got)
+	}
+	// Flush without events does not queue an empty batch.
+	h.batch.Flush()
+	if n := q.Len(); n != 0 {
+		t.Fatalf("want no empty batch queued; got %d", n)
+	}
+}
+
+func TestBatcherKeep(t *testing.T) {
+	q := newQueue(policyDrop, 0)
+	b := newBatcher(time.Hour, q)
+	missed := ev("a", 1)
+	missed.keep = true
+	b.Add(missed)
+	b.Add(ev("b", 2))
+	flushed := make(chan struct{})
+	go func() {
+		b.Flush()
+		close(flushed)
+	}()
+	e, _ := q.Pop()
+	q.Done(e)
+	<-flushed
+	if n := q.Dropped(); n != 0 {
+		t.Fatalf("want batch with missed event not dropped; got dropped=%d", n)
+	}
+	if len(e.batch) != 2 {
+		t.Fatalf("want batch of 2 events; got %d", len(e.batch))
+	}
+}
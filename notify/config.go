@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ghodss/yaml"
+	"github.com/rjeczalik/notify"
+)
+
+// configFile describes the file read with the -config flag.
+type configFile struct {
+	Watches []json.RawMessage `json:"watches"`
+}
+
+type watchConfig struct {
+	Paths        []string          `json:"paths"`
+	Events       string            `json:"events"`
+	Include      []string          `json:"include"`
+	Exclude      []string          `json:"exclude"`
+	NotifyIgnore bool              `json:"notifyignore"`
+	Debounce     value             `json:"debounce"`
+	Poll         value             `json:"poll"`
+	PollFallback bool              `json:"poll-fallback"`
+	Dir          string            `json:"dir"`
+	Env          map[string]string `json:"env"`
+	Handlers     []json.RawMessage `json:"handlers"`
+}
+
+type handlerConfig struct {
+	Command   string            `json:"command"`
+	File      string            `json:"file"`
+	Events    value             `json:"events"`
+	Queue     value             `json:"queue"`
+	QueueSize value             `json:"queue-size"`
+	Jobs      value             `json:"j"`
+	Restart   bool              `json:"restart"`
+	Grace     value             `json:"grace"`
+	Shell     value             `json:"shell"`
+	Retry     value             `json:"retry"`
+	Backoff   value             `json:"backoff"`
+	OnFailure string            `json:"on-failure"`
+	MaxFails  value             `json:"max-failures"`
+	Batch     value             `json:"batch"`
+	Dir       string            `json:"dir"`
+	EnvFile   string            `json:"env-file"`
+	Env       map[string]string `json:"env"`
+	Timeout   value             `json:"run-timeout"`
+}
+
+// value is an option value, which can be given either as a string,
+// a number or a boolean.
+type value string
+
+func (v *value) UnmarshalJSON(p []byte) error {
+	var n json.Number
+	if err := json.Unmarshal(p, &n); err == nil {
+		*v = value(n)
+		return nil
+	}
+	var b bool
+	if err := json.Unmarshal(p, &b); err == nil {
+		*v = value(strconv.FormatBool(b))
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(p, &s); err != nil {
+		return err
+	}
+	*v = value(s)
+	return nil
+}
+
+// loadConfig reads watches from the given YAML or JSON file. Relative paths
+// in the file are resolved against the file's directory.
+func loadConfig(file string) ([]*watch, error) {
+	p, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	p, err = yaml.YAMLToJSON(p)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", file, err)
+	}
+	var cfg configFile
+	if err := decode(p, &cfg); err != nil {
+		return nil, fmt.Errorf("%s: %s", file, err)
+	}
+	if len(cfg.Watches) == 0 {
+		return nil, fmt.Errorf("%s: no watches defined", file)
+	}
+	base := filepath.Dir(file)
+	watches := make([]*watch, 0, len(cfg.Watches))
+	for i, raw := range cfg.Watches {
+		var wc watchConfig
+		if err := decode(raw, &wc); err != nil {
+			return nil, fmt.Errorf("%s: watches[%d]: %s", file, i, err)
+		}
+		w, err := wc.watch(base)
+		if err != nil {
+			return nil, fmt.Errorf("%s: watches[%d]: %s", file, i, err)
+		}
+		watches = append(watches, w)
+	}
+	return watches, nil
+}
+
+// decode unmarshals the JSON, rejecting unknown fields. YAML 1.1 reads
+// unquoted on key as true, the error for it suggests the events key instead.
+func decode(p []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(p))
+	dec.DisallowUnknownFields()
+	err := dec.Decode(v)
+	if err != nil && strings.HasSuffix(err.Error(), `unknown field "true"`) {
+		return fmt.Errorf(`%s (use "events" instead of "on")`, err)
+	}
+	return err
+}
+
+func (wc *watchConfig) watch(base string) (*watch, error) {
+	if len(wc.Paths) == 0 {
+		return nil, errors.New("no paths defined")
+	}
+	paths := make([]string, len(wc.Paths))
+	for i, path := range wc.Paths {
+		paths[i] = resolve(base, path)
+	}
+	w, err := newWatch(paths, wc.NotifyIgnore)
+	if err != nil {
+		return nil, err
+	}
+	if wc.Events != "" {
+		var e events
+		if err := e.Set(wc.Events); err != nil {
+			return nil, fmt.Errorf("events: %s", err)
+		}
+		w.events = notify.Event(e)
+	}
+	for i, s := range wc.Include {
+		if err := w.filter.include.Set(s); err != nil {
+			return nil, fmt.Errorf("include[%d]: %s", i, err)
+		}
+	}
+	for i, s := range wc.Exclude {
+		if err := w.filter.exclude.Set(s); err != nil {
+			return nil, fmt.Errorf("exclude[%d]: %s", i, err)
+		}
+	}
+	if wc.Debounce != "" {
+		if w.debounce, err = time.ParseDuration(string(wc.Debounce)); err != nil {
+			return nil, fmt.Errorf("debounce: %s", err)
+		}
+	}
+	if wc.Poll != "" {
+		if w.poll, err = time.ParseDuration(string(wc.Poll)); err != nil {
+			return nil, fmt.Errorf("poll: %s", err)
+		}
+	}
+	w.fallback = wc.PollFallback
+	opts := defaults
+	if wc.Dir != "" {
+		opts.Dir = resolve(base, wc.Dir)
+	}
+	opts.Env = append(opts.Env[:len(opts.Env):len(opts.Env)], sortedEnv(wc.Env)...)
+	for i, raw := range wc.Handlers {
+		var hc handlerConfig
+		if err := decode(raw, &hc); err != nil {
+			return nil, fmt.Errorf("handlers[%d]: %s", i, err)
+		}
+		h, err := hc.handler(base, opts)
+		if err != nil {
+			return nil, fmt.Errorf("handlers[%d]: %s", i, err)
+		}
+		w.handlers = append(w.handlers, h)
+	}
+	return w, nil
+}
+
+func (hc *handlerConfig) handler(base string, opts handlerOptions) (*handler, error) {
+	spec := &handlerSpec{
+		Command:        hc.Command,
+		handlerOptions: opts,
+	}
+	switch {
+	case hc.Command == "" && hc.File == "":
+		return nil, errors.New("either command or file is required")
+	case hc.Command != "" && hc.File != "":
+		return nil, errors.New("command and file are mutually exclusive")
+	case hc.File != "":
+		spec.File = resolve(base, hc.File)
+	}
+	set := []struct {
+		name  string
+		value value
+		fn    func(*handlerOptions, string) error
+	}{
+		{"events", hc.Events, setEvents},
+		{"queue", hc.Queue, setPolicy},
+		{"queue-size", hc.QueueSize, setQueueSize},
+		{"j", hc.Jobs, setJobs},
+		{"grace", hc.Grace, setGrace},
+		{"shell", hc.Shell, setShell},
+		{"retry", hc.Retry, setRetry},
+		{"backoff", hc.Backoff, setBackoff},
+		{"on-failure", value(hc.OnFailure), setOnFailure},
+		{"max-failures", hc.MaxFails, setMaxFailures},
+		{"batch", hc.Batch, setBatch},
+		{"run-timeout", hc.Timeout, setRunTimeout},
+	}
+	for _, set := range set {
+		if set.value == "" {
+			continue
+		}
+		if err := set.fn(&spec.handlerOptions, string(set.value)); err != nil {
+			return nil, fmt.Errorf("%s: %s", set.name, err)
+		}
+	}
+	if hc.Dir != "" {
+		if err := setDir(&spec.handlerOptions, resolve(base, hc.Dir)); err != nil {
+			return nil, fmt.Errorf("dir: %s", err)
+		}
+	}
+	if hc.EnvFile != "" {
+		if err := setEnvFile(&spec.handlerOptions, resolve(base, hc.EnvFile)); err != nil {
+			return nil, fmt.Errorf("env-file: %s", err)
+		}
+	}
+	for _, kv := range sortedEnv(hc.Env) {
+		if err := setEnv(&spec.handlerOptions, kv); err != nil {
+			return nil, fmt.Errorf("env: %s", err)
+		}
+	}
+	spec.Restart = hc.Restart
+	return spec.handler()
+}
+
+func resolve(base, path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(base, path)
+}
+
+// sortedEnv gives KEY=VALUE pairs of the map sorted by keys.
+func sortedEnv(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	env := make([]string, len(keys))
+	for i, k := range keys {
+		env[i] = k + "=" + m[k]
+	}
+	return env
+}
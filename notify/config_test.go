@@ -0,0 +1,129 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rjeczalik/notify"
+)
+
+// configExample is the example given in the documentation of the -config flag.
+const configExample = `watches:
+- paths: [./src/...]
+  events: create,write
+  include: ["*.go"]
+  exclude: [.git, "re:_test\\.go$"]
+  notifyignore: true
+  debounce: 500ms
+  dir: ./src
+  env:
+    GOFLAGS: -mod=vendor
+  handlers:
+  - command: go test ./...
+    queue: latest
+  - file: ./lint.tmpl
+    events: create
+    j: 4
+`
+
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "src"), 0755); err != nil {
+		t.Fatalf("Mkdir()=%v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "lint.tmpl"), []byte("golint {{.Path}}"), 0644); err != nil {
+		t.Fatalf("WriteFile()=%v", err)
+	}
+	file := filepath.Join(dir, "notify.yaml")
+	if err := ioutil.WriteFile(file, []byte(configExample), 0644); err != nil {
+		t.Fatalf("WriteFile()=%v", err)
+	}
+	watches, err := loadConfig(file)
+	if err != nil {
+		t.Fatalf("loadConfig()=%v", err)
+	}
+	if len(watches) != 1 {
+		t.Fatalf("want len(watches)=1; got %d", len(watches))
+	}
+	w := watches[0]
+	if len(w.wps) != 1 || w.wps[0].Path != filepath.Join(dir, "src")+"/..." {
+		t.Errorf("want one watchpoint for %q; got %+v", filepath.Join(dir, "src")+"/...", w.wps)
+	}
+	if want := notify.Create | notify.Write; w.events != want {
+		t.Errorf("want events=%v; got %v", want, w.events)
+	}
+	if w.debounce != 500*time.Millisecond {
+		t.Errorf("want debounce=500ms; got %v", w.debounce)
+	}
+	for file, want := range map[string]bool{"a.go": true, "a_test.go": false, ".git/a.go": false, "a.txt": false} {
+		if got := w.filter.match(w.wps[0], filepath.Join(w.wps[0].Root, file)); got != want {
+			t.Errorf("want match(%q)=%t; got %t", file, want, got)
+		}
+	}
+	if len(w.handlers) != 2 {
+		t.Fatalf("want len(handlers)=2; got %d", len(w.handlers))
+	}
+	test, lint := w.handlers[0], w.handlers[1]
+	if test.queue.policy != policyLatest {
+		t.Errorf("want queue=%s; got %s", policyLatest, test.queue.policy)
+	}
+	if test.events != 0 {
+		t.Errorf("want events=0; got %v", test.events)
+	}
+	if lint.events != notify.Create {
+		t.Errorf("want events=%v; got %v", notify.Create, lint.events)
+	}
+	if lint.jobs != 4 {
+		t.Errorf("want jobs=4; got %d", lint.jobs)
+	}
+	for _, h := range w.handlers {
+		if h.dir != filepath.Join(dir, "src") {
+			t.Errorf("want dir=%q; got %q", filepath.Join(dir, "src"), h.dir)
+		}
+		if !equal(h.env, []string{"GOFLAGS=-mod=vendor"}) {
+			t.Errorf(`want env=["GOFLAGS=-mod=vendor"]; got %q`, h.env)
+		}
+	}
+}
+
+func TestLoadConfigError(t *testing.T) {
+	cases := [...]struct {
+		content string
+		err     string
+	}{
+		0:  {"watches: []\n", "no watches defined"},
+		1:  {"watches:\n- paths: []\n", "watches[0]: no paths defined"},
+		2:  {"watches:\n- paths: [.]\n  foo: create\n", `watches[0]: json: unknown field "foo"`},
+		3:  {"watches:\n- paths: [.]\n- paths: [.]\n  debounce: 1y\n", "watches[1]: debounce: "},
+		4:  {"watches:\n- paths: [.]\n  events: foo\n", "watches[0]: events: "},
+		5:  {"watches:\n- paths: [.]\n  include: [\"[\"]\n", "watches[0]: include[0]: "},
+		6:  {"watches:\n- paths: [.]\n  handlers:\n  - {}\n", "watches[0]: handlers[0]: either command or file is required"},
+		7:  {"watches:\n- paths: [.]\n  handlers:\n  - command: x\n    file: ./y\n", "watches[0]: handlers[0]: command and file are mutually exclusive"},
+		8:  {"watches:\n- paths: [.]\n  handlers:\n  - command: x\n  - command: x\n    queue: foo\n", "watches[0]: handlers[1]: queue: "},
+		9:  {"watches:\n- paths: [.]\n  handlers:\n  - command: x\n    events: foo\n", "watches[0]: handlers[0]: events: "},
+		10: {"watches:\n- paths: [.]\n  handlers:\n  - command: x\n    j: x\n", "watches[0]: handlers[0]: j: "},
+		11: {"watches:\n- paths: [.]\n  handlers:\n  - command: x\n    dir: ./missing\n", "watches[0]: handlers[0]: dir: "},
+		12: {"watches:\n- paths: [.]\n  handlers:\n  - command: x\n    foo: 1\n", `watches[0]: handlers[0]: json: unknown field "foo"`},
+		13: {"watches:\n- paths: [.]\n  handlers:\n  - command: '{{'\n", "watches[0]: handlers[0]: "},
+		14: {"watches:\n- paths: [.]\n  handlers:\n  - command: x\n    on: create\n", `watches[0]: handlers[0]: json: unknown field "true" (use "events" instead of "on")`},
+	}
+	dir := t.TempDir()
+	file := filepath.Join(dir, "notify.yaml")
+	for i, cas := range cases {
+		if err := ioutil.WriteFile(file, []byte(cas.content), 0644); err != nil {
+			t.Fatalf("WriteFile()=%v", err)
+		}
+		_, err := loadConfig(file)
+		if err == nil {
+			t.Errorf("want err!=nil (i=%d)", i)
+			continue
+		}
+		if want := file + ": " + cas.err; !strings.HasPrefix(err.Error(), want) {
+			t.Errorf("want err to start with %q; got %q (i=%d)", want, err, i)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"sort"
+	"time"
+)
+
+// pending is an event waiting for its quiet window to pass.
+type pending struct {
+	e     Event
+	gen   int
+	timer *time.Timer
+}
+
+type expired struct {
+	path string
+	gen  int
+}
+
+// merge adds the kind of the given event to the pending one, keeping
+// the latest kind as the Event value.
+func (p *pending) merge(e Event) {
+	p.e.Event = e.Event
+	p.e.Time = e.Time
+	p.e.Seq = e.Seq
+	p.e.keep = p.e.keep || e.keep
+	if e.OldPath != "" {
+		p.e.OldPath = e.OldPath
+	}
+	for _, k := range e.Kinds {
+		if !contains(p.e.Kinds, k) {
+			p.e.Kinds = append(p.e.Kinds, k)
+		}
+	}
+}
+
+func contains(s []string, v string) bool {
+	for _, s := range s {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
+
+// coalesce reads events from in and forwards them to the returned channel
+// once no new events were received for the same path during d. Events for
+// the same path received in the meantime are merged into a single one.
+//
+// The returned channel is closed after in is closed and all the pending
+// events are flushed.
+func coalesce(in <-chan Event, d time.Duration) <-chan Event {
+	out := make(chan Event)
+	go func() {
+		m := make(map[string]*pending)
+		c := make(chan expired)
+		for {
+			select {
+			case e, ok := <-in:
+				if !ok {
+					flush(m, out)
+					close(out)
+					return
+				}
+				p, ok := m[e.Path]
+				if !ok {
+					p = &pending{e: e}
+					p.e.Kinds = append([]string(nil), e.Kinds...)
+					m[e.Path] = p
+				} else {
+					p.timer.Stop()
+					p.merge(e)
+				}
+				p.gen++
+				exp := expired{path: e.Path, gen: p.gen}
+				p.timer = time.AfterFunc(d, func() { c <- exp })
+			case exp := <-c:
+				// A timer may fire after it was superseded by a newer one,
+				// ignore such stale expirations.
+				if p, ok := m[exp.path]; ok && p.gen == exp.gen {
+					delete(m, exp.path)
+					out <- p.e
+				}
+			}
+		}
+	}()
+	return out
+}
+
+// flush sends all the pending events to out, ordered by path.
+func flush(m map[string]*pending, out chan<- Event) {
+	paths := make([]string, 0, len(m))
+	for path, p := range m {
+		p.timer.Stop()
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		out <- m[path].e
+	}
+}
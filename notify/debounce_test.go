@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func send(events []Event) chan Event {
+	in := make(chan Event, len(events))
+	for _, e := range events {
+		in <- e
+	}
+	return in
+}
+
+func describe(e Event) string {
+	s := fmt.Sprintf("%s %s %v", e.Path, e.Event, e.Kinds)
+	if e.OldPath != "" {
+		s += " " + e.OldPath
+	}
+	return s
+}
+
+func TestCoalesce(t *testing.T) {
+	cases := [...]struct {
+		in  []Event
+		out []string
+	}{
+		0: {
+			[]Event{{Path: "a", Event: "write", Kinds: []string{"write"}}},
+			[]string{"a write [write]"},
+		},
+		1: {
+			[]Event{
+				{Path: "a", Event: "create", Kinds: []string{"create"}},
+				{Path: "a", Event: "write", Kinds: []string{"write"}},
+				{Path: "a", Event: "write", Kinds: []string{"write"}},
+			},
+			[]string{"a write [create write]"},
+		},
+		2: {
+			[]Event{
+				{Path: "b", Event: "write", Kinds: []string{"write"}},
+				{Path: "a", Event: "remove", Kinds: []string{"remove"}},
+				{Path: "b", Event: "write", Kinds: []string{"write"}},
+			},
+			[]string{"a remove [remove]", "b write [write]"},
+		},
+		3: {
+			[]Event{
+				{Path: "a", Event: "create", Kinds: []string{"create"}},
+				{Path: "a", Event: "rename", Kinds: []string{"rename"}, OldPath: "x"},
+			},
+			[]string{"a rename [create rename] x"},
+		},
+	}
+	for i, cas := range cases {
+		in := send(cas.in)
+		close(in)
+		var out []string
+		for e := range coalesce(in, time.Hour) {
+			out = append(out, describe(e))
+		}
+		if !equal(out, cas.out) {
+			t.Errorf("want out=%v; got %v (i=%d)", cas.out, out, i)
+		}
+	}
+}
+
+func TestCoalesceQuietWindow(t *testing.T) {
+	in := make(chan Event)
+	defer close(in)
+	out := coalesce(in, 50*time.Millisecond)
+	in <- Event{Path: "a", Event: "create", Kinds: []string{"create"}}
+	in <- Event{Path: "a", Event: "write", Kinds: []string{"write"}}
+	select {
+	case e := <-out:
+		if s := describe(e); s != "a write [create write]" {
+			t.Fatalf("want a write [create write]; got %s", s)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("want event after quiet window")
+	}
+	in <- Event{Path: "a", Event: "remove", Kinds: []string{"remove"}}
+	if e := <-out; describe(e) != "a remove [remove]" {
+		t.Fatalf("want a remove [remove]; got %s", describe(e))
+	}
+}
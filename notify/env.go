@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+func setDir(o *handlerOptions, s string) error {
+	fi, err := os.Stat(s)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("%s is not a directory", s)
+	}
+	o.Dir = s
+	return nil
+}
+
+func setEnv(o *handlerOptions, s string) error {
+	if i := strings.IndexByte(s, '='); i <= 0 {
+		return fmt.Errorf("invalid variable %q, want KEY=VALUE", s)
+	}
+	// Options are copied from the defaults, so the slice is copied
+	// before appending in order not to share its backing array.
+	o.Env = append(o.Env[:len(o.Env):len(o.Env)], s)
+	return nil
+}
+
+func setEnvFile(o *handlerOptions, s string) error {
+	env, err := readDotenv(s)
+	if err != nil {
+		return err
+	}
+	o.EnvFile = append(o.EnvFile[:len(o.EnvFile):len(o.EnvFile)], env...)
+	return nil
+}
+
+// readDotenv reads KEY=VALUE pairs from the file in dotenv format. Lines
+// may start with export, values may be single- or double-quoted, and
+// blank lines and lines starting with # are ignored.
+func readDotenv(file string) ([]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var env []string
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+		i := strings.IndexByte(line, '=')
+		if i <= 0 {
+			return nil, fmt.Errorf("%s:%d: invalid line %q", file, n, line)
+		}
+		key := strings.TrimSpace(line[:i])
+		val, err := dotenvValue(strings.TrimSpace(line[i+1:]))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", file, n, err)
+		}
+		env = append(env, key+"="+val)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return env, nil
+}
+
+func dotenvValue(s string) (string, error) {
+	if s == "" {
+		return "", nil
+	}
+	switch q := s[0]; q {
+	case '\'', '"':
+		i := strings.LastIndexByte(s, q)
+		if i == 0 {
+			return "", fmt.Errorf("unterminated quote in %s", s)
+		}
+		if rest := strings.TrimSpace(s[i+1:]); rest != "" && rest[0] != '#' {
+			return "", fmt.Errorf("unexpected %q after quoted value", rest)
+		}
+		s = s[1:i]
+		if q == '"' {
+			s = strings.NewReplacer(`\n`, "\n", `\t`, "\t", `\"`, `"`, `\\`, `\`).Replace(s)
+		}
+		return s, nil
+	}
+	if i := strings.Index(s, " #"); i != -1 {
+		s = strings.TrimSpace(s[:i])
+	}
+	return s, nil
+}
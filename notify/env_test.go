@@ -0,0 +1,55 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadDotenv(t *testing.T) {
+	cases := [...]struct {
+		content string
+		env     []string
+	}{
+		0: {"A=1\nB=2\n", []string{"A=1", "B=2"}},
+		1: {"# comment\n\n  A = 1  \n", []string{"A=1"}},
+		2: {"export A=1\n", []string{"A=1"}},
+		3: {"A=\n", []string{"A="}},
+		4: {"A=1 # comment\nB=x#y\n", []string{"A=1", "B=x#y"}},
+		5: {"A='$HOME \\n' # comment\n", []string{`A=$HOME \n`}},
+		6: {`A="a\tb\n\"c\"\\"` + "\n", []string{"A=a\tb\n\"c\"\\"}},
+		7: {"A=x=y\n", []string{"A=x=y"}},
+	}
+	casesErr := []string{
+		0: "A\n",
+		1: "=1\n",
+		2: "A='1\n",
+		3: "A=\"1\" x\n",
+	}
+	dir := t.TempDir()
+	file := filepath.Join(dir, ".env")
+	for i, cas := range cases {
+		if err := ioutil.WriteFile(file, []byte(cas.content), 0644); err != nil {
+			t.Fatalf("WriteFile()=%v", err)
+		}
+		env, err := readDotenv(file)
+		if err != nil {
+			t.Errorf("want err=nil; got %v (i=%d)", err, i)
+			continue
+		}
+		if !equal(env, cas.env) {
+			t.Errorf("want env=%q; got %q (i=%d)", cas.env, env, i)
+		}
+	}
+	for i, content := range casesErr {
+		if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatalf("WriteFile()=%v", err)
+		}
+		if _, err := readDotenv(file); err == nil {
+			t.Errorf("want err!=nil (i=%d)", i)
+		}
+	}
+	if _, err := readDotenv(filepath.Join(dir, "missing")); err == nil {
+		t.Error("want err!=nil for missing file")
+	}
+}
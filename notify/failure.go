@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os/exec"
+	"strconv"
+	"time"
+)
+
+// tailSize is the number of trailing bytes of the command's stderr,
+// which are passed to the failure handler.
+const tailSize = 4096
+
+// fatal receives an error, which makes notify stop and exit with non-zero
+// status.
+var fatal = make(chan error, 1)
+
+// Failure is passed to the template of the -on-failure handler.
+type Failure struct {
+	Event
+	Handler  string // the failed handler
+	Error    string // error message
+	ExitCode int    // exit code of the command or -1 if it did not exit
+	Stderr   string // trailing output of the command's stderr
+	Attempts int    // number of times the command was run
+	Failures int    // number of consecutive failures of the handler
+}
+
+func setRetry(o *handlerOptions, s string) error {
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return err
+	}
+	if n < 0 {
+		return fmt.Errorf("invalid number of retries %d", n)
+	}
+	o.Retry = n
+	return nil
+}
+
+func setBackoff(o *handlerOptions, s string) error {
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	o.Backoff = d
+	return nil
+}
+
+func setOnFailure(o *handlerOptions, s string) error {
+	o.OnFailure = s
+	return nil
+}
+
+func setMaxFailures(o *handlerOptions, s string) error {
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return err
+	}
+	if n < 0 {
+		return fmt.Errorf("invalid number of failures %d", n)
+	}
+	o.MaxFails = n
+	return nil
+}
+
+// succeeded resets the number of consecutive failures.
+func (h *handler) succeeded() {
+	h.mu.Lock()
+	h.fails = 0
+	h.mu.Unlock()
+}
+
+// failing reports whether the last run of the handler's command failed.
+func (h *handler) failing() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.fails != 0
+}
+
+// failed logs the error and runs the failure handler, if any. When the
+// number of consecutive failures reaches the limit, notify is stopped.
+// The p argument is nil if the command failed to start.
+func (h *handler) failed(e Event, p *process, err error, attempts int) {
+	log.Println("handler error:", err)
+	h.mu.Lock()
+	h.fails++
+	fails := h.fails
+	h.mu.Unlock()
+	if h.failure != nil {
+		f := Failure{
+			Event:    e,
+			Handler:  h.name,
+			Error:    err.Error(),
+			ExitCode: -1,
+			Attempts: attempts,
+			Failures: fails,
+		}
+		if e, ok := err.(*exec.ExitError); ok {
+			f.ExitCode = e.ExitCode()
+		}
+		if p != nil {
+			f.Stderr = p.tail.String()
+		}
+		fp, err := h.failure.start(f, e)
+		if err == nil {
+			err = fp.Wait()
+		}
+		if err != nil {
+			log.Println("failure handler error:", err)
+		}
+	}
+	if h.maxFail != 0 && fails >= h.maxFail {
+		select {
+		case fatal <- fmt.Errorf("handler %q failed %d times in a row", h.name, fails):
+		default:
+		}
+	}
+}
+
+// tailWriter keeps the last size bytes written to it.
+type tailWriter struct {
+	buf  []byte
+	size int
+}
+
+func newTailWriter(size int) *tailWriter {
+	return &tailWriter{size: size}
+}
+
+func (tw *tailWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	if len(p) > tw.size {
+		p = p[len(p)-tw.size:]
+	}
+	if over := len(tw.buf) + len(p) - tw.size; over > 0 {
+		tw.buf = append(tw.buf[:0], tw.buf[over:]...)
+	}
+	tw.buf = append(tw.buf, p...)
+	return n, nil
+}
+
+func (tw *tailWriter) String() string {
+	return string(tw.buf)
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/rjeczalik/cmd/internal/ignore"
+)
+
+const ignoreFile = ".notifyignore"
+
+// watchpoint describes a path notify listens on.
+type watchpoint struct {
+	Path   string        // path as passed to notify.Watch
+	Root   string        // absolute path of the watched directory, symlinks resolved
+	ignore *ignore.Rules // rules read from .notifyignore file or nil
+}
+
+func newWatchpoint(p string) (*watchpoint, error) {
+	dir := strings.TrimSuffix(p, "...")
+	if dir == "" {
+		dir = "."
+	}
+	root, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	// Paths of the events received from notify have symlinks resolved.
+	if r, err := filepath.EvalSymlinks(root); err == nil {
+		root = r
+	}
+	return &watchpoint{Path: p, Root: root}, nil
+}
+
+// readIgnore reads .notifyignore file from the watched directory, if the file
+// exists.
+func (wp *watchpoint) readIgnore() error {
+	rules, err := ignore.ParseFile(filepath.Join(wp.Root, ignoreFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	wp.ignore = rules
+	return nil
+}
+
+// rel gives a slash-separated path relative to the watched directory.
+func (wp *watchpoint) rel(p string) string {
+	rel, err := filepath.Rel(wp.Root, p)
+	if err != nil {
+		return filepath.ToSlash(p)
+	}
+	return filepath.ToSlash(rel)
+}
+
+// lookup gives a watchpoint, which the path belongs to. If more than one
+// watchpoint matches, the one with the longest root is returned.
+func lookup(wps []*watchpoint, p string) *watchpoint {
+	var found *watchpoint
+	for _, wp := range wps {
+		if !within(wp.Root, p) {
+			continue
+		}
+		if found == nil || len(wp.Root) > len(found.Root) {
+			found = wp
+		}
+	}
+	return found
+}
+
+func within(root, p string) bool {
+	if !strings.HasPrefix(p, root) {
+		return false
+	}
+	return len(p) == len(root) || p[len(root)] == os.PathSeparator || strings.HasSuffix(root, string(os.PathSeparator))
+}
+
+// pattern is either a glob pattern or, when prefixed with "re:", a regular
+// expression.
+type pattern struct {
+	glob string
+	re   *regexp.Regexp
+}
+
+func newPattern(s string) (pattern, error) {
+	if strings.HasPrefix(s, "re:") {
+		re, err := regexp.Compile(s[len("re:"):])
+		if err != nil {
+			return pattern{}, err
+		}
+		return pattern{re: re}, nil
+	}
+	if s == "" {
+		return pattern{}, errors.New("empty pattern")
+	}
+	if _, err := path.Match(s, ""); err != nil {
+		return pattern{}, err
+	}
+	return pattern{glob: s}, nil
+}
+
+// match tests the pattern against the path. Regular expressions are matched
+// against the absolute path, glob patterns containing a slash are matched
+// against the slash-separated path relative to the watched directory,
+// other glob patterns are matched against each of the path elements.
+func (p pattern) match(abs, rel string) bool {
+	if p.re != nil {
+		return p.re.MatchString(abs)
+	}
+	if strings.Contains(p.glob, "/") {
+		ok, _ := path.Match(p.glob, rel)
+		return ok
+	}
+	for _, elem := range strings.Split(rel, "/") {
+		if ok, _ := path.Match(p.glob, elem); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (p pattern) String() string {
+	if p.re != nil {
+		return "re:" + p.re.String()
+	}
+	return p.glob
+}
+
+// patterns is a flag.Value, which collects patterns passed with repeated
+// flag.
+type patterns []pattern
+
+func (p *patterns) String() string {
+	s := make([]string, 0, len(*p))
+	for _, p := range *p {
+		s = append(s, p.String())
+	}
+	return strings.Join(s, ",")
+}
+
+func (p *patterns) Set(s string) error {
+	pat, err := newPattern(s)
+	if err != nil {
+		return err
+	}
+	*p = append(*p, pat)
+	return nil
+}
+
+func (p patterns) match(abs, rel string) bool {
+	for _, p := range p {
+		if p.match(abs, rel) {
+			return true
+		}
+	}
+	return false
+}
+
+// filter decides whether an event for the given path should be handled.
+type filter struct {
+	include patterns
+	exclude patterns
+}
+
+// match reports whether the path passes the filter. The path is rejected
+// when it is ignored by watchpoint's .notifyignore rules, matches any
+// of the exclude patterns or, when include patterns were given, does not
+// match any of them.
+func (f *filter) match(wp *watchpoint, p string) bool {
+	rel := filepath.ToSlash(p)
+	if wp != nil {
+		rel = wp.rel(p)
+		if wp.ignore != nil && wp.ignore.Match(rel, isDir(p)) {
+			return false
+		}
+	}
+	if f.exclude.match(p, rel) {
+		return false
+	}
+	return len(f.include) == 0 || f.include.match(p, rel)
+}
+
+func isDir(p string) bool {
+	fi, err := os.Lstat(p)
+	return err == nil && fi.IsDir()
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFilter(t *testing.T) {
+	cases := [...]struct {
+		include []string
+		exclude []string
+		rel     string
+		ok      bool
+	}{
+		0:  {nil, nil, "a.go", true},
+		1:  {[]string{"*.go"}, nil, "a.go", true},
+		2:  {[]string{"*.go"}, nil, "src/a.go", true},
+		3:  {[]string{"*.go"}, nil, "a.txt", false},
+		4:  {[]string{"src/*.go"}, nil, "src/a.go", true},
+		5:  {[]string{"src/*.go"}, nil, "a.go", false},
+		6:  {[]string{"src/*.go"}, nil, "lib/src/a.go", false},
+		7:  {[]string{"src/*.go"}, nil, "src/pkg/a.go", false},
+		8:  {nil, []string{".git"}, ".git/HEAD", false},
+		9:  {nil, []string{".git"}, "a/.git/HEAD", false},
+		10: {nil, []string{".git"}, "a.git", true},
+		11: {[]string{`re:\.go$`}, nil, "src/a.go", true},
+		12: {[]string{`re:\.go$`}, nil, "src/a.go.txt", false},
+		13: {nil, []string{`re:_test\.go$`}, "a_test.go", false},
+		14: {[]string{"*.go"}, []string{`re:_test\.go$`}, "a_test.go", false},
+		15: {[]string{"*.go"}, []string{`re:_test\.go$`}, "a.go", true},
+		16: {[]string{"src"}, []string{"*.go"}, "src/a.go", false},
+		17: {[]string{"src"}, []string{"*.go"}, "src/a.txt", true},
+		18: {[]string{"*.go", "*.mod"}, nil, "go.mod", true},
+	}
+	dir := t.TempDir()
+	wp, err := newWatchpoint(filepath.Join(dir, "..."))
+	if err != nil {
+		t.Fatalf("newWatchpoint()=%v", err)
+	}
+	for i, cas := range cases {
+		var f filter
+		for _, s := range cas.include {
+			if err := f.include.Set(s); err != nil {
+				t.Fatalf("Set(%q)=%v (i=%d)", s, err, i)
+			}
+		}
+		for _, s := range cas.exclude {
+			if err := f.exclude.Set(s); err != nil {
+				t.Fatalf("Set(%q)=%v (i=%d)", s, err, i)
+			}
+		}
+		if ok := f.match(wp, filepath.Join(wp.Root, filepath.FromSlash(cas.rel))); ok != cas.ok {
+			t.Errorf("want match(%q)=%t; got %t (i=%d)", cas.rel, cas.ok, ok, i)
+		}
+	}
+	for i, s := range []string{"", "[", "re:("} {
+		var p patterns
+		if err := p.Set(s); err == nil {
+			t.Errorf("want err!=nil for %q (i=%d)", s, i)
+		}
+	}
+}
+
+func TestLookupSymlink(t *testing.T) {
+	dir := t.TempDir()
+	real := filepath.Join(dir, "real")
+	if err := os.MkdirAll(filepath.Join(real, "src"), 0755); err != nil {
+		t.Fatalf("MkdirAll()=%v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(real, ignoreFile), []byte("*.log\n"), 0644); err != nil {
+		t.Fatalf("WriteFile()=%v", err)
+	}
+	link := filepath.Join(dir, "link")
+	if err := os.Symlink(real, link); err != nil {
+		t.Skipf("Symlink()=%v", err)
+	}
+	w, err := newWatch([]string{filepath.Join(link, "...")}, true)
+	if err != nil {
+		t.Fatalf("newWatch()=%v", err)
+	}
+	if err := w.filter.include.Set("src/*"); err != nil {
+		t.Fatalf("Set()=%v", err)
+	}
+	// Events received from notify have symlinks resolved.
+	resolved, err := filepath.EvalSymlinks(real)
+	if err != nil {
+		t.Fatalf("EvalSymlinks()=%v", err)
+	}
+	cases := [...]struct {
+		rel string
+		ok  bool
+	}{
+		0: {"src/a.go", true},
+		1: {"src/a.log", false},
+		2: {"a.go", false},
+	}
+	for i, cas := range cases {
+		p := filepath.Join(resolved, filepath.FromSlash(cas.rel))
+		wp := lookup(w.wps, p)
+		if wp == nil {
+			t.Errorf("want watchpoint for %q (i=%d)", p, i)
+			continue
+		}
+		if rel := wp.rel(p); rel != cas.rel {
+			t.Errorf("want rel=%q; got %q (i=%d)", cas.rel, rel, i)
+		}
+		if ok := w.filter.match(wp, p); ok != cas.ok {
+			t.Errorf("want match(%q)=%t; got %t (i=%d)", cas.rel, cas.ok, ok, i)
+		}
+	}
+}
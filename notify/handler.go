@@ -0,0 +1,588 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"text/template"
+	"time"
+
+	"github.com/rjeczalik/cmd/internal/cmd"
+	"github.com/rjeczalik/notify"
+)
+
+// handlerOptions holds settings of a single handler.
+type handlerOptions struct {
+	Events    notify.Event  // events the handler is run for; 0 means all
+	Queue     policy        // what to do with events when the handler is busy
+	QueueSize int           // max number of queued events for oldest and block policies
+	Jobs      int           // max number of commands run at once
+	Restart   bool          // whether to restart running command on new event
+	Grace     time.Duration // time given to the command to exit after SIGTERM
+	Dir       string        // working directory of the command
+	Env       []string      // additional environment of the command
+	EnvFile   []string      // environment read from -env-file, overridden by Env
+	Timeout   time.Duration // max time a single run of the command may take
+	Shell     []string      // shell the script is run with; nil runs the command directly
+	Retry     int           // number of times failed command is retried
+	Backoff   time.Duration // delay before the first retry, doubled for each next one
+	OnFailure string        // template of the command run when the handler fails
+	MaxFails  int           // number of consecutive failures, which stops notify
+	Batch     time.Duration // window events are collected in for a single run
+}
+
+// handlerSpec describes a handler registered with the -c or -f flag.
+type handlerSpec struct {
+	Command string // template text given with -c flag
+	File    string // template file given with -f flag
+	handlerOptions
+}
+
+func (spec *handlerSpec) handler() (*handler, error) {
+	text := spec.Command
+	if spec.File != "" {
+		p, err := ioutil.ReadFile(spec.File)
+		if err != nil {
+			return nil, err
+		}
+		text = string(p)
+	}
+	name := spec.Command
+	if spec.File != "" {
+		name = spec.File
+	}
+	h, err := newHandler(name, text, spec.handlerOptions)
+	if err != nil {
+		return nil, err
+	}
+	h.file = spec.File
+	return h, nil
+}
+
+// options gives options set by handler flags. The flags apply to the most
+// recently registered handler; if no handler was registered yet, they set
+// the defaults for all handlers registered afterwards.
+func options() *handlerOptions {
+	if len(specs) == 0 {
+		return &defaults
+	}
+	return &specs[len(specs)-1].handlerOptions
+}
+
+// handlerFlag is a flag.Value, which registers a new handler on each flag
+// occurrence.
+type handlerFlag struct {
+	file bool
+}
+
+func (handlerFlag) String() string { return "" }
+
+func (f handlerFlag) Set(s string) error {
+	spec := &handlerSpec{handlerOptions: defaults}
+	if f.file {
+		spec.File = s
+	} else {
+		spec.Command = s
+	}
+	specs = append(specs, spec)
+	return nil
+}
+
+// optionFlag is a flag.Value, which sets an option returned by options.
+type optionFlag func(*handlerOptions, string) error
+
+func (optionFlag) String() string { return "" }
+
+func (f optionFlag) Set(s string) error {
+	return f(options(), s)
+}
+
+// boolOptionFlag is an optionFlag for boolean options.
+type boolOptionFlag func(*handlerOptions, bool)
+
+func (boolOptionFlag) String() string   { return "" }
+func (boolOptionFlag) IsBoolFlag() bool { return true }
+
+func (f boolOptionFlag) Set(s string) error {
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		return err
+	}
+	f(options(), b)
+	return nil
+}
+
+func setJobs(o *handlerOptions, s string) error {
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return err
+	}
+	if n < 1 {
+		return fmt.Errorf("invalid number of jobs %d", n)
+	}
+	o.Jobs = n
+	return nil
+}
+
+func setRestart(o *handlerOptions, b bool) {
+	o.Restart = b
+}
+
+func setGrace(o *handlerOptions, s string) error {
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	o.Grace = d
+	return nil
+}
+
+func setRunTimeout(o *handlerOptions, s string) error {
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	o.Timeout = d
+	return nil
+}
+
+func setEvents(o *handlerOptions, s string) error {
+	var e events
+	if err := e.Set(s); err != nil {
+		return err
+	}
+	o.Events = notify.Event(e)
+	return nil
+}
+
+var funcs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		p, err := json.Marshal(v)
+		if err != nil {
+			return "", err
+		}
+		return string(p), nil
+	},
+	"quote": func(s string) string {
+		return strconv.Quote(s)
+	},
+	"base64": func(s string) string {
+		return base64.RawStdEncoding.EncodeToString([]byte(s))
+	},
+	"shellquote": shellquote,
+	"raw":        raw,
+}
+
+type handler struct {
+	name    string
+	file    string
+	tmpl    atomic.Value // *template.Template
+	events  notify.Event
+	queue   *queue
+	jobs    int
+	restart bool
+	grace   time.Duration
+	dir     string
+	env     []string
+	timeout time.Duration
+	shell   []string
+	retry   int
+	backoff time.Duration
+	failure *handler
+	maxFail int
+	batch   *batcher
+
+	wg    sync.WaitGroup
+	mu    sync.Mutex
+	fails int // number of consecutive failures
+}
+
+func newHandler(name, text string, opts handlerOptions) (*handler, error) {
+	tmpl, err := parseHandler(text, opts.Shell != nil)
+	if err != nil {
+		return nil, err
+	}
+	h := &handler{
+		name:    name,
+		events:  opts.Events,
+		jobs:    opts.Jobs,
+		restart: opts.Restart,
+		grace:   opts.Grace,
+		dir:     opts.Dir,
+		env:     append(opts.EnvFile[:len(opts.EnvFile):len(opts.EnvFile)], opts.Env...),
+		timeout: opts.Timeout,
+		shell:   opts.Shell,
+		retry:   opts.Retry,
+		backoff: opts.Backoff,
+		maxFail: opts.MaxFails,
+	}
+	h.tmpl.Store(tmpl)
+	if opts.OnFailure != "" {
+		fopts := opts
+		fopts.OnFailure, fopts.Retry, fopts.MaxFails, fopts.Restart, fopts.Batch = "", 0, 0, false, 0
+		if h.failure, err = newHandler(opts.OnFailure, opts.OnFailure, fopts); err != nil {
+			return nil, err
+		}
+	}
+	if h.jobs < 1 || h.restart {
+		h.jobs = 1
+	}
+	if h.restart {
+		// Events are not dropped in restart mode, as it is the most
+		// recent one, which the command is restarted with.
+		h.queue = newQueue(policyUnbounded, 0)
+	} else {
+		h.queue = newQueue(opts.Queue, opts.QueueSize)
+	}
+	if opts.Batch > 0 {
+		h.batch = newBatcher(opts.Batch, h.queue)
+	}
+	return h, nil
+}
+
+func parseHandler(text string, shell bool) (*template.Template, error) {
+	tmpl, err := template.New("main.Handler").Funcs(funcs).Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	if shell {
+		escape(tmpl)
+	}
+	return tmpl, nil
+}
+
+func (h *handler) template() *template.Template {
+	return h.tmpl.Load().(*template.Template)
+}
+
+// Reload parses the handler's file again. On error the previous template
+// is kept.
+func (h *handler) Reload() error {
+	if h.file == "" {
+		return nil
+	}
+	p, err := ioutil.ReadFile(h.file)
+	if err != nil {
+		return err
+	}
+	tmpl, err := parseHandler(string(p), h.shell != nil)
+	if err != nil {
+		return err
+	}
+	h.tmpl.Store(tmpl)
+	return nil
+}
+
+// accepts reports whether any of the event values is one the handler
+// is run for.
+func (h *handler) accepts(e Event) bool {
+	if h.events == 0 {
+		return true
+	}
+	for _, k := range e.Kinds {
+		if h.events&kind(k) != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// process is a command started by the handler.
+type process struct {
+	cmd    *exec.Cmd
+	stdout *lineWriter
+	stderr *lineWriter
+	tail   *tailWriter
+	grace  time.Duration
+	done   chan struct{}
+}
+
+// Wait waits for the command to exit.
+func (p *process) Wait() error {
+	err := p.cmd.Wait()
+	if p.stdout != nil {
+		p.stdout.Flush()
+		p.stderr.Flush()
+	}
+	running.remove(p)
+	close(p.done)
+	return err
+}
+
+// Terminate sends SIGTERM to the command's process group and SIGKILL
+// if the command does not exit within the grace period. The done channel
+// receives the result of Wait.
+func (p *process) Terminate(grace time.Duration, done <-chan error) {
+	if err := signalGroup(p.cmd, syscall.SIGTERM); err != nil {
+		log.Println("handler error:", err)
+	}
+	select {
+	case <-done:
+	case <-time.After(grace):
+		if err := signalGroup(p.cmd, syscall.SIGKILL); err != nil {
+			log.Println("handler error:", err)
+		}
+		<-done
+	}
+}
+
+// Start starts the command rendered from the template for the given event.
+func (h *handler) Start(e Event) (*process, error) {
+	if e.batch != nil {
+		return h.start(newBatch(e), e)
+	}
+	return h.start(e, e)
+}
+
+// start starts the command rendered from the template for the given data,
+// with environment set for the given event.
+func (h *handler) start(data interface{}, e Event) (*process, error) {
+	var buf bytes.Buffer
+	if err := h.template().Execute(&buf, data); err != nil {
+		return nil, err
+	}
+	var name string
+	var args []string
+	if h.shell != nil {
+		name, args = h.shell[0], append(h.shell[1:len(h.shell):len(h.shell)], buf.String())
+	} else {
+		name, args = cmd.Split(buf.String())
+	}
+	p := &process{
+		cmd:   exec.Command(name, args...),
+		tail:  newTailWriter(tailSize),
+		grace: h.grace,
+		done:  make(chan struct{}),
+	}
+	p.cmd.Dir = h.dir
+	p.cmd.Env = append(env(e), h.env...)
+	if h.jobs == 1 {
+		p.cmd.Stdout = os.Stdout
+		p.cmd.Stderr = io.MultiWriter(os.Stderr, p.tail)
+	} else {
+		p.stdout = newLineWriter(os.Stdout)
+		p.stderr = newLineWriter(os.Stderr)
+		p.cmd.Stdout = p.stdout
+		p.cmd.Stderr = io.MultiWriter(p.stderr, p.tail)
+	}
+	setpgid(p.cmd)
+	if err := p.cmd.Start(); err != nil {
+		return nil, err
+	}
+	running.add(p)
+	return p, nil
+}
+
+// handle runs the command for the event, retrying it if it fails.
+func (h *handler) handle(e Event) {
+	backoff := h.backoff
+	for attempt := 1; ; attempt++ {
+		if cancelled() {
+			return
+		}
+		p, err := h.Start(e)
+		if err == nil {
+			err = h.wait(p)
+		}
+		if err == nil {
+			h.succeeded()
+			return
+		}
+		if attempt > h.retry || cancelled() {
+			h.failed(e, p, err, attempt)
+			return
+		}
+		log.Printf("handler error: %s (retrying in %s)", err, backoff)
+		t := time.NewTimer(backoff)
+		select {
+		case <-t.C:
+		case <-cancel:
+			t.Stop()
+			h.failed(e, p, err, attempt)
+			return
+		}
+		backoff *= 2
+	}
+}
+
+// Send queues the event for the handler. It returns false if any event was
+// dropped due to the handler's queue policy.
+func (h *handler) Send(e Event) bool {
+	if h.batch != nil {
+		h.batch.Add(e)
+		return true
+	}
+	return h.queue.Push(e)
+}
+
+// Close stops the handler from accepting new events.
+func (h *handler) Close() {
+	if h.batch != nil {
+		h.batch.Flush()
+	}
+	h.queue.Close()
+}
+
+// Wait waits until the handler, after it was closed, processed all
+// the queued events.
+func (h *handler) Wait() {
+	h.wg.Wait()
+}
+
+// Daemon starts the handler, which runs up to h.jobs commands at once.
+func (h *handler) Daemon() {
+	if h.restart {
+		h.wg.Add(1)
+		go func() {
+			defer h.wg.Done()
+			h.supervise()
+		}()
+		return
+	}
+	for i := 0; i < h.jobs; i++ {
+		h.wg.Add(1)
+		go func() {
+			defer h.wg.Done()
+			for {
+				e, ok := h.queue.Pop()
+				if !ok {
+					return
+				}
+				h.handle(e)
+				h.queue.Done(e)
+			}
+		}()
+	}
+}
+
+// wait waits for the command to exit. If the command runs longer than
+// the handler's timeout, it is terminated.
+func (h *handler) wait(p *process) error {
+	if h.timeout <= 0 {
+		return p.Wait()
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- p.Wait()
+	}()
+	t := time.NewTimer(h.timeout)
+	defer t.Stop()
+	select {
+	case err := <-done:
+		return err
+	case <-t.C:
+		log.Printf("handler %q timed out after %s", h.name, h.timeout)
+		p.Terminate(h.grace, done)
+		return fmt.Errorf("timed out after %s", h.timeout)
+	}
+}
+
+// supervise runs the command for the most recent event. If a new event
+// is received while the command is still running, the command is terminated
+// and started again for the new event.
+func (h *handler) supervise() {
+	e, ok := h.queue.Pop()
+	for ok {
+		p, err := h.Start(e)
+		if err != nil {
+			h.failed(e, nil, err, 1)
+			h.queue.Done(e)
+			e, ok = h.queue.Pop()
+			continue
+		}
+		done := make(chan error, 1)
+		go func() {
+			done <- p.Wait()
+		}()
+		var t *time.Timer
+		var expired <-chan time.Time
+		if h.timeout > 0 {
+			t = time.NewTimer(h.timeout)
+			expired = t.C
+		}
+	wait:
+		for {
+			select {
+			case <-expired:
+				log.Printf("handler %q timed out after %s", h.name, h.timeout)
+				p.Terminate(h.grace, done)
+				h.failed(e, p, fmt.Errorf("timed out after %s", h.timeout), 1)
+				h.queue.Done(e)
+				break wait
+			case err := <-done:
+				if err != nil {
+					h.failed(e, p, err, 1)
+				} else {
+					h.succeeded()
+				}
+				h.queue.Done(e)
+				break wait
+			case <-h.queue.Wake():
+				if h.queue.Len() == 0 {
+					continue
+				}
+				log.Printf("restarting handler %q", h.name)
+				p.Terminate(h.grace, done)
+				h.queue.Done(e)
+				h.queue.Squash()
+				break wait
+			}
+		}
+		if t != nil {
+			t.Stop()
+		}
+		e, ok = h.queue.Pop()
+	}
+}
+
+// output guards writes of concurrently running commands to os.Stdout
+// and os.Stderr.
+var output sync.Mutex
+
+// lineWriter buffers command output and writes it to w only in complete
+// lines, so output of concurrently running commands does not interleave
+// mid-line.
+type lineWriter struct {
+	w   io.Writer
+	buf []byte
+}
+
+func newLineWriter(w io.Writer) *lineWriter {
+	return &lineWriter{w: w}
+}
+
+func (lw *lineWriter) Write(p []byte) (int, error) {
+	lw.buf = append(lw.buf, p...)
+	if i := bytes.LastIndexByte(lw.buf, '\n'); i != -1 {
+		output.Lock()
+		_, err := lw.w.Write(lw.buf[:i+1])
+		output.Unlock()
+		lw.buf = append(lw.buf[:0], lw.buf[i+1:]...)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// Flush writes remaining output, which does not end with a newline.
+func (lw *lineWriter) Flush() error {
+	if len(lw.buf) == 0 {
+		return nil
+	}
+	output.Lock()
+	_, err := lw.w.Write(append(lw.buf, '\n'))
+	output.Unlock()
+	lw.buf = lw.buf[:0]
+	return err
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"text/template"
+	"time"
+)
+
+// readLines gives the lines of the file written by the test's commands.
+func readLines(t *testing.T, file string) []string {
+	p, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatalf("ReadFile()=%v", err)
+	}
+	return strings.Split(strings.TrimSpace(string(p)), "\n")
+}
+
+func newShellHandler(t *testing.T, text string, opts handlerOptions) *handler {
+	if runtime.GOOS == "windows" {
+		t.Skip("requires /bin/sh")
+	}
+	opts.Shell = []string{"/bin/sh", "-c"}
+	if opts.Jobs == 0 {
+		opts.Jobs = 1
+	}
+	h, err := newHandler("test", text, opts)
+	if err != nil {
+		t.Fatalf("newHandler()=%v", err)
+	}
+	return h
+}
+
+func TestHandleRetry(t *testing.T) {
+	dir := t.TempDir()
+	out, fail := filepath.Join(dir, "out"), filepath.Join(dir, "fail")
+	opts := handlerOptions{
+		Retry:     2,
+		Backoff:   time.Millisecond,
+		OnFailure: "echo {{.Rel}} {{.Attempts}} {{.ExitCode}} {{.Failures}} {{.Stderr}} >> " + shellquote(fail),
+		MaxFails:  2,
+	}
+	h := newShellHandler(t, "echo {{.Rel}} >> "+shellquote(out)+"; printf oops >&2; exit 3", opts)
+	defer func() {
+		select {
+		case <-fatal:
+		default:
+		}
+	}()
+	h.handle(Event{Path: filepath.Join(dir, "a"), Rel: "a"})
+	if want, got := []string{"a", "a", "a"}, readLines(t, out); !equal(got, want) {
+		t.Errorf("want runs=%q; got %q", want, got)
+	}
+	if want, got := []string{"a 3 3 1 oops"}, readLines(t, fail); !equal(got, want) {
+		t.Errorf("want failures=%q; got %q", want, got)
+	}
+	if !h.failing() {
+		t.Error("want handler failing")
+	}
+	select {
+	case err := <-fatal:
+		t.Fatalf("want no fatal error after 1 failure; got %v", err)
+	default:
+	}
+	h.handle(Event{Path: filepath.Join(dir, "b"), Rel: "b"})
+	if want, got := []string{"a 3 3 1 oops", "b 3 3 2 oops"}, readLines(t, fail); !equal(got, want) {
+		t.Errorf("want failures=%q; got %q", want, got)
+	}
+	select {
+	case err := <-fatal:
+		if want := `handler "test" failed 2 times in a row`; err.Error() != want {
+			t.Errorf("want err=%q; got %q", want, err)
+		}
+	default:
+		t.Error("want fatal error after 2 failures")
+	}
+}
+
+func TestHandleRetrySucceeded(t *testing.T) {
+	dir := t.TempDir()
+	out, marker := filepath.Join(dir, "out"), filepath.Join(dir, "marker")
+	opts := handlerOptions{
+		Retry:    3,
+		Backoff:  time.Millisecond,
+		MaxFails: 1,
+	}
+	// The command fails the first time it is run for each path.
+	text := "echo {{.Rel}} >> " + shellquote(out) + "; [ -e " + shellquote(marker) + "{{.Rel}} ] || { touch " + shellquote(marker) + "{{.Rel}}; exit 1; }"
+	h := newShellHandler(t, text, opts)
+	h.handle(Event{Path: filepath.Join(dir, "a"), Rel: "a"})
+	if want, got := []string{"a", "a"}, readLines(t, out); !equal(got, want) {
+		t.Errorf("want runs=%q; got %q", want, got)
+	}
+	if h.failing() {
+		t.Error("want handler not failing")
+	}
+	select {
+	case err := <-fatal:
+		t.Errorf("want no fatal error; got %v", err)
+	default:
+	}
+}
+
+func TestHandleRetryCancel(t *testing.T) {
+	dir := t.TempDir()
+	out := filepath.Join(dir, "out")
+	h := newShellHandler(t, "echo {{.Rel}} >> "+shellquote(out)+"; exit 1", handlerOptions{Retry: 1, Backoff: time.Hour})
+	defer func() { cancel = make(chan struct{}) }()
+	done := make(chan struct{})
+	go func() {
+		h.handle(Event{Path: filepath.Join(dir, "a"), Rel: "a"})
+		close(done)
+	}()
+	time.Sleep(200 * time.Millisecond)
+	close(cancel)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("handle did not return after cancel")
+	}
+	if want, got := []string{"a"}, readLines(t, out); !equal(got, want) {
+		t.Errorf("want runs=%q; got %q", want, got)
+	}
+	if !h.failing() {
+		t.Error("want handler failing")
+	}
+}
+
+func TestFuncs(t *testing.T) {
+	cases := [...]struct {
+		text string
+		want string
+	}{
+		0: {"{{base64 .Path}}", "L3RtcC9hLmdv"},
+		1: {"{{base64 .Rel}}", "YS5nbw"},
+		2: {"{{quote .Rel}}", `"a.go"`},
+		3: {"{{json .Kinds}}", `["create","write"]`},
+		4: {"{{shellquote .OldPath}}", `'/tmp/it'\''s'`},
+	}
+	e := Event{Path: "/tmp/a.go", Rel: "a.go", Kinds: []string{"create", "write"}, OldPath: "/tmp/it's"}
+	for i, cas := range cases {
+		tmpl, err := template.New("").Funcs(funcs).Parse(cas.text)
+		if err != nil {
+			t.Fatalf("Parse()=%v (i=%d)", err, i)
+		}
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, e); err != nil {
+			t.Fatalf("Execute()=%v (i=%d)", err, i)
+		}
+		if buf.String() != cas.want {
+			t.Errorf("want %q; got %q (i=%d)", cas.want, buf.String(), i)
+		}
+	}
+}
+
+func TestNewenv(t *testing.T) {
+	t.Setenv("NOTIFY_PATH", "inherited")
+	t.Setenv("NOTIFY_TEST", "1")
+	e := Event{
+		Path:    "/tmp/src/a.go",
+		Event:   "write",
+		Kinds:   []string{"create", "write"},
+		Dir:     "/tmp/src",
+		Base:    "a.go",
+		Ext:     ".go",
+		Rel:     "src/a.go",
+		Root:    "/tmp",
+		Time:    time.Date(2020, 1, 2, 3, 4, 5, 6, time.UTC),
+		OldPath: "/tmp/src/b.go",
+		Seq:     42,
+	}
+	want := map[string]string{
+		"NOTIFY_PATH":    "/tmp/src/a.go",
+		"NOTIFY_EVENT":   "write",
+		"NOTIFY_KINDS":   "create,write",
+		"NOTIFY_DIR":     "/tmp/src",
+		"NOTIFY_BASE":    "a.go",
+		"NOTIFY_EXT":     ".go",
+		"NOTIFY_REL":     "src/a.go",
+		"NOTIFY_ROOT":    "/tmp",
+		"NOTIFY_TIME":    "2020-01-02T03:04:05.000000006Z",
+		"NOTIFY_OLDPATH": "/tmp/src/b.go",
+		"NOTIFY_SEQ":     "42",
+		"NOTIFY_TEST":    "1",
+	}
+	got := make(map[string]string)
+	for _, kv := range newenv()(e) {
+		kv := strings.SplitN(kv, "=", 2)
+		if _, ok := got[kv[0]]; ok {
+			t.Errorf("want %s set once", kv[0])
+		}
+		got[kv[0]] = kv[1]
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("want %s=%q; got %q", k, v, got[k])
+		}
+	}
+	for _, name := range envNames {
+		if _, ok := want[name]; !ok {
+			t.Errorf("want %s tested", name)
+		}
+	}
+}
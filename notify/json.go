@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"time"
+)
+
+// jsonEvent is an event printed with the -json flag.
+type jsonEvent struct {
+	Path    string     `json:"path"`
+	Event   string     `json:"event"`
+	Kinds   []string   `json:"kinds"`
+	Time    time.Time  `json:"time"`
+	Root    string     `json:"root,omitempty"`
+	Rel     string     `json:"rel,omitempty"`
+	OldPath string     `json:"old_path,omitempty"`
+	Seq     uint64     `json:"seq"`
+	Size    *int64     `json:"size,omitempty"`
+	Mode    string     `json:"mode,omitempty"`
+	ModTime *time.Time `json:"mtime,omitempty"`
+}
+
+func newJSONEvent(e Event) jsonEvent {
+	v := jsonEvent{
+		Path:    e.Path,
+		Event:   e.Event,
+		Kinds:   e.Kinds,
+		Time:    e.Time,
+		Root:    e.Root,
+		Rel:     e.Rel,
+		OldPath: e.OldPath,
+		Seq:     e.Seq,
+	}
+	if fi, err := os.Lstat(e.Path); err == nil {
+		size, mtime := fi.Size(), fi.ModTime()
+		v.Size = &size
+		v.Mode = fi.Mode().String()
+		v.ModTime = &mtime
+	}
+	return v
+}
+
+// printJSON writes the event to w as a single line JSON object.
+func printJSON(w io.Writer, e Event) error {
+	p, err := json.Marshal(newJSONEvent(e))
+	if err != nil {
+		return err
+	}
+	output.Lock()
+	defer output.Unlock()
+	_, err = w.Write(append(p, '\n'))
+	return err
+}
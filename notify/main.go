@@ -7,20 +7,44 @@
 //
 // Usage
 //
-//    usage: notify [-c command] [-f script file] [path]...
+//    usage: notify [-c command]... [-f script file]... [-on events]
+//                  [-e events] [-queue policy] [-queue-size n] [-j n] [-restart]
+//                  [-grace duration] [-shell[=command]] [-retry n]
+//                  [-backoff duration] [-on-failure command] [-max-failures n]
+//                  [-batch window] [-dir dir] [-env-file file] [-env KEY=VALUE]...
+//                  [-run-timeout duration] [-debounce duration]
+//                  [-include pattern]... [-exclude pattern]... [-notifyignore]
+//                  [-poll interval] [-poll-fallback]
+//                  [-state file [-state-hash] [-state-interval duration]]
+//                  [-once [-timeout duration]] [-shutdown-timeout duration] [-json]
+//                  [-serve addr] [-record file] [-replay file [-speed n]]
+//                  [-config file] [path]...
 //
 // The -c flag registers a command handler, which uses the syntax
 // of package template. Notify passes struct to the template,
 // splits produced string into command and args, and runs it using
-// exec.Command(). Additionaly the path and event type values are
-// accesible to the process via NOTIFY_PATH and NOTIFY_EVENT
-// environment variables.
+// exec.Command(). Additionaly the event fields are accesible to the
+// process via NOTIFY_PATH, NOTIFY_EVENT, NOTIFY_KINDS, NOTIFY_DIR,
+// NOTIFY_BASE, NOTIFY_EXT, NOTIFY_REL, NOTIFY_ROOT, NOTIFY_TIME,
+// NOTIFY_OLDPATH and NOTIFY_SEQ environment variables. Besides the
+// builtin functions the template can use json, quote and base64
+// functions, which work as in gotmpl, except that json gives compact
+// output on a single line.
 //
 // The struct being passed to the template is:
 //
 //   type Event struct {
-//       Path  string
-//       Event string
+//       Path    string
+//       Event   string
+//       Kinds   []string
+//       Dir     string
+//       Base    string
+//       Ext     string
+//       Rel     string
+//       Root    string
+//       Time    time.Time
+//       OldPath string
+//       Seq     uint64
 //   }
 //
 // Values for the Event field are:
@@ -30,10 +54,200 @@
 //   - rename
 //   - write
 //
+// The Kinds field holds all the event values received for the path,
+// it has more than one element only when events were coalesced.
+// The Dir, Base and Ext fields are the directory, the last element and
+// the extension of the path, the Rel field is the path relative to the
+// watched directory, which is the Root field. The Time field is the time
+// the event was received, the Seq field is the event's sequence number.
+// For a file moved within the watched directories the create event has
+// the OldPath field set to the path the file was moved from, if the
+// platform reports it (currently Linux only).
+//
 // The -t flag registers a file handler, which works similary
 // to the -c handler. The only difference the template is read from
 // the given file instead of the command line.
 //
+// The -shell flag makes the handler pass the script produced by the template
+// to a shell, instead of splitting it into command and args. It allows for
+// using pipes, redirections and globbing in the script. By default it
+// is $SHELL -c or, if the variable is not set, /bin/sh -c; other shell can
+// be given with -shell='bash -c'. In the shell mode the output of every
+// template action is quoted with the shellquote function, unless the action
+// already ends with shellquote or raw, e.g. {{.Path | raw}}.
+//
+// The -retry flag sets the number of times the handler's command is run
+// again after it fails, waiting the duration set with the -backoff flag
+// (1s by default) before the first retry and twice as long before each
+// next one. The -on-failure flag registers a command, which is run after
+// the handler fails. Its template is passed the Failure struct, which
+// embeds the Event and has additionaly the Handler, Error, ExitCode,
+// Stderr (trailing output of the failed command), Attempts and Failures
+// (number of consecutive failures) fields. The -max-failures flag makes
+// notify stop and exit with non-zero status after the handler fails the
+// given number of times in a row. In the restart mode failed commands are
+// not retried.
+//
+// The -dir flag sets the working directory of the handler's command. The
+// -env-file flag reads additional environment of the command from a file
+// in dotenv format, the -env flag, which can be repeated, sets a single
+// KEY=VALUE variable overriding the file. The environment is built anew
+// for every run of the command. The -run-timeout flag makes the handler
+// terminate its command, if it runs longer than the given duration, and
+// treat the run as failed. In the -config file the options are set per
+// handler with the dir, env-file, env and run-timeout keys.
+//
+// The -c and -f flags can be repeated in order to register more handlers.
+//
+// The -e flag sets comma-separated list of event values notify listens on.
+// By default notify listens on all of them.
+//
+// The -on flag sets comma-separated list of event values the handler is run
+// for. Handler flags, like -on, apply to the handler registered with the
+// preceding -c or -f flag. When given before any handler they set the
+// defaults for all the handlers registered afterwards.
+//
+// The -queue flag sets the policy for events received while the handler
+// is busy, the -queue-size flag sets the maximum number of events kept
+// in a bounded queue (64 by default). Possible policies are:
+//
+//   - drop      drops the event (default)
+//   - oldest    queues the event, dropping the oldest one when the queue is full
+//   - unbounded queues the event
+//   - block     queues the event, waiting for the handler when the queue is full
+//   - latest    queues the event, replacing a queued event for the same path
+//
+// Number of dropped events is reported on exit.
+//
+// The -j flag sets the maximum number of commands the handler runs at once,
+// by default it is 1. Events for the same path are always handled in order.
+// Output of the commands run concurrently is written line by line.
+//
+// The -restart flag makes the handler terminate its running command when
+// a new event is received, and start it again for the most recent event.
+// The command's process group is sent SIGTERM first, then SIGKILL if it
+// does not exit within the duration set with the -grace flag (5s by
+// default). In the restart mode the -j and -queue flags are ignored.
+//
+// The -batch flag makes the handler collect events received within the given
+// window, which starts with the first of them, and run the command once for
+// all of them. The template is then passed a Batch value, which embeds the
+// last event of the batch and adds the Events field with all the collected
+// events and the Paths field with their unique paths:
+//
+//   notify -batch 500ms -include '*.go' -c 'gofmt -l {{range .Paths}}{{.}} {{end}}'
+//
+// The -debounce flag makes notify wait until no new events were received
+// for a path during the given duration, before the handlers are run.
+// All the events received for the path in the meantime are coalesced
+// into a single one.
+//
+// The -include and -exclude flags filter events by the path. Both flags
+// can be repeated. A pattern prefixed with "re:" is a regular expression
+// matched against the absolute path, otherwise it is a glob pattern. Glob
+// patterns containing a slash are matched against the path relative to
+// the watched directory, other ones are matched against each path element.
+// An event is handled when its path does not match any of the -exclude
+// patterns and matches one of the -include patterns, if any were given.
+//
+// The -notifyignore flag makes notify read .notifyignore file from each
+// of the watched directories. The file uses the gitignore syntax.
+//
+// The -json flag makes notify print each event to os.Stdout as a single
+// line JSON object, with the path, the event values, the time, the watched
+// directory and, if the file still exists, its size, mode and modification
+// time.
+//
+// The -poll flag makes notify poll the paths for changes with the given
+// interval instead of listening on them, which is useful on network and
+// FUSE filesystems or bind mounts, where filesystem events are not
+// delivered. Create, write, remove and rename events are synthesized by
+// comparing size, modification time and inode of the files between polls.
+// The -poll-fallback flag makes notify poll only the paths it failed to
+// listen on, with the -poll interval or every second. In the -config file
+// the flags are set per watch with the poll and poll-fallback keys.
+//
+// The -state flag makes notify keep a snapshot of the watched trees, with
+// the size, modification time and inode of each file, in the given file.
+// The snapshot is saved on exit and every -state-interval (1m by default).
+// On start the snapshot is compared with the current state of the trees
+// and events for the differences are handled before the received ones.
+// They are never dropped by the -queue policy; notify waits for the busy
+// handlers instead.
+// The -state-hash flag adds SHA-256 hashes of the files to the snapshot,
+// so only files with changed content are reported as written.
+//
+// The -once flag makes notify exit after the first event, which passed the
+// filters, was handled. If no handler is specified the path of the event is
+// printed to os.Stdout. The exit status is 0, or 1 if the handler's command
+// failed. The -timeout flag, which requires -once, makes notify exit with
+// status 2 when no event was handled within the given duration.
+//
+//   notify -once -e create -include '*.tar.gz' -timeout 10m dist/
+//
+// The -serve flag makes notify serve events over HTTP on the given address,
+// e.g. -serve :8080. The /events endpoint streams the events as Server-Sent
+// Events and the /ws endpoint streams them over WebSocket, each event being
+// the JSON object printed with the -json flag. Both endpoints accept path
+// and kind query parameters, which can be repeated: the path parameter is a
+// path prefix or a glob pattern, the kind parameter is a comma-separated list
+// of event values, e.g. /events?path=*.css&kind=create,write. The /status
+// endpoint serves a JSON object with the number of events, sent and dropped
+// messages and connected clients.
+//
+// The -record flag appends each received event to the given file, as the
+// JSON object printed with the -json flag. The -replay flag reads events
+// recorded in the given file and passes them to the handlers instead of
+// listening on the paths; notify exits after all of them were handled.
+// Events are replayed with the recorded intervals, which are scaled by
+// the -speed flag, e.g. -speed 2x replays events twice as fast and -speed 0
+// replays them without delays. Filters, the -e and -debounce flags apply to
+// the replayed events as to the received ones. Replayed events are never
+// dropped by the -queue policy; notify waits for the busy handlers instead.
+//
+// The -config flag reads watches from the given YAML or JSON file instead
+// of the command line. Each of the watches has its own paths, events,
+// filters, debounce duration, polling, working directory, environment and
+// handlers.
+// Relative paths are resolved against the directory of the file. Handler
+// options are named after their flags, except for the -on flag, which is
+// named events as for the watch. The -config flag cannot be used
+// together with path arguments, handler flags or the -e, -include, -exclude,
+// -notifyignore, -debounce, -poll and -poll-fallback flags, which are set
+// per watch in the file instead.
+//
+//   watches:
+//   - paths: [./src/...]
+//     events: create,write
+//     include: ["*.go"]
+//     exclude: [.git, "re:_test\\.go$"]
+//     notifyignore: true
+//     debounce: 500ms
+//     dir: ./src
+//     env:
+//       GOFLAGS: -mod=vendor
+//     handlers:
+//     - command: go test ./...
+//       queue: latest
+//     - file: ./lint.tmpl
+//       events: create
+//       j: 4
+//
+// On SIGINT or SIGTERM notify stops listening on the paths and waits for the
+// handlers to handle queued events for up to the duration set with the
+// -shutdown-timeout flag (10s by default). If the handlers do not finish in
+// time, or the signal is received again, the queued events are dropped and
+// the signal is forwarded to the process groups of the running commands,
+// which are killed if they do not exit within the -grace period. The exit
+// status is 0 if all the events were handled, or 128 plus the signal number
+// if the handlers were cancelled.
+//
+// Handler files registered with -f and the -config file are watched for
+// changes and reloaded without restarting notify. When a file fails to parse
+// the previous version is kept and the error is logged. Sending SIGHUP forces
+// a reload. Changes to the configuration other than handler templates
+// require a restart.
+//
 // The path argument tells notify which director or directories to
 // listen on. By default notify listens recursively in current working
 // directory.
@@ -62,21 +276,35 @@
 package main
 
 import (
-	"bytes"
+	"errors"
 	"flag"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"os"
-	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
 	"strings"
-	"text/template"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
-	"github.com/rjeczalik/cmd/internal/cmd"
 	"github.com/rjeczalik/notify"
 )
 
-const usage = `usage: notify [-c command] [-f script file] [path]...
+const usage = `usage: notify [-c command]... [-f script file]... [-on events]
+              [-e events] [-queue policy] [-queue-size n] [-j n] [-restart]
+              [-grace duration] [-shell[=command]] [-retry n]
+              [-backoff duration] [-on-failure command] [-max-failures n]
+              [-batch window] [-dir dir] [-env-file file] [-env KEY=VALUE]...
+              [-run-timeout duration] [-debounce duration]
+              [-include pattern]... [-exclude pattern]... [-notifyignore]
+              [-poll interval] [-poll-fallback]
+              [-state file [-state-hash] [-state-interval duration]]
+              [-once [-timeout duration]] [-shutdown-timeout duration] [-json]
+              [-serve addr] [-record file] [-replay file [-speed n]]
+              [-config file] [path]...
 
 Listens on filesystem changes and forwards received mapping to
 user-defined handlers.
@@ -84,15 +312,28 @@ user-defined handlers.
 The -c flag registers a command handler, which uses the syntax
 of package template. Notify passes struct to the template,
 splits produced string into command and args, and runs it using
-exec.Command(). Additionaly the path and event type values are
-accesible to the process via NOTIFY_PATH and NOTIFY_EVENT
-environment variables.
+exec.Command(). Additionaly the event fields are accesible to the
+process via NOTIFY_PATH, NOTIFY_EVENT, NOTIFY_KINDS, NOTIFY_DIR,
+NOTIFY_BASE, NOTIFY_EXT, NOTIFY_REL, NOTIFY_ROOT, NOTIFY_TIME,
+NOTIFY_OLDPATH and NOTIFY_SEQ environment variables. Besides the
+builtin functions the template can use json, quote and base64
+functions, which work as in gotmpl, except that json gives compact
+output on a single line.
 
 The struct being passed to the template is:
 
 	type Event struct {
-		Path  string
-		Event string
+		Path    string
+		Event   string
+		Kinds   []string
+		Dir     string
+		Base    string
+		Ext     string
+		Rel     string
+		Root    string
+		Time    time.Time
+		OldPath string
+		Seq     uint64
 	}
 
 Values for the Event field are:
@@ -102,10 +343,200 @@ Values for the Event field are:
 	- rename
 	- write
 
+The Kinds field holds all the event values received for the path,
+it has more than one element only when events were coalesced.
+The Dir, Base and Ext fields are the directory, the last element and
+the extension of the path, the Rel field is the path relative to the
+watched directory, which is the Root field. The Time field is the time
+the event was received, the Seq field is the event's sequence number.
+For a file moved within the watched directories the create event has
+the OldPath field set to the path the file was moved from, if the
+platform reports it (currently Linux only).
+
 The -t flag registers a file handler, which works similary
 to the -c handler. The only difference the template is read from
 the given file instead of the command line.
 
+The -shell flag makes the handler pass the script produced by the template
+to a shell, instead of splitting it into command and args. It allows for
+using pipes, redirections and globbing in the script. By default it
+is $SHELL -c or, if the variable is not set, /bin/sh -c; other shell can
+be given with -shell='bash -c'. In the shell mode the output of every
+template action is quoted with the shellquote function, unless the action
+already ends with shellquote or raw, e.g. {{.Path | raw}}.
+
+The -retry flag sets the number of times the handler's command is run
+again after it fails, waiting the duration set with the -backoff flag
+(1s by default) before the first retry and twice as long before each
+next one. The -on-failure flag registers a command, which is run after
+the handler fails. Its template is passed the Failure struct, which
+embeds the Event and has additionaly the Handler, Error, ExitCode,
+Stderr (trailing output of the failed command), Attempts and Failures
+(number of consecutive failures) fields. The -max-failures flag makes
+notify stop and exit with non-zero status after the handler fails the
+given number of times in a row. In the restart mode failed commands are
+not retried.
+
+The -dir flag sets the working directory of the handler's command. The
+-env-file flag reads additional environment of the command from a file
+in dotenv format, the -env flag, which can be repeated, sets a single
+KEY=VALUE variable overriding the file. The environment is built anew
+for every run of the command. The -run-timeout flag makes the handler
+terminate its command, if it runs longer than the given duration, and
+treat the run as failed. In the -config file the options are set per
+handler with the dir, env-file, env and run-timeout keys.
+
+The -c and -f flags can be repeated in order to register more handlers.
+
+The -e flag sets comma-separated list of event values notify listens on.
+By default notify listens on all of them.
+
+The -on flag sets comma-separated list of event values the handler is run
+for. Handler flags, like -on, apply to the handler registered with the
+preceding -c or -f flag. When given before any handler they set the
+defaults for all the handlers registered afterwards.
+
+The -queue flag sets the policy for events received while the handler
+is busy, the -queue-size flag sets the maximum number of events kept
+in a bounded queue (64 by default). Possible policies are:
+
+	- drop      drops the event (default)
+	- oldest    queues the event, dropping the oldest one when the queue is full
+	- unbounded queues the event
+	- block     queues the event, waiting for the handler when the queue is full
+	- latest    queues the event, replacing a queued event for the same path
+
+Number of dropped events is reported on exit.
+
+The -j flag sets the maximum number of commands the handler runs at once,
+by default it is 1. Events for the same path are always handled in order.
+Output of the commands run concurrently is written line by line.
+
+The -restart flag makes the handler terminate its running command when
+a new event is received, and start it again for the most recent event.
+The command's process group is sent SIGTERM first, then SIGKILL if it
+does not exit within the duration set with the -grace flag (5s by
+default). In the restart mode the -j and -queue flags are ignored.
+
+The -batch flag makes the handler collect events received within the given
+window, which starts with the first of them, and run the command once for
+all of them. The template is then passed a Batch value, which embeds the
+last event of the batch and adds the Events field with all the collected
+events and the Paths field with their unique paths:
+
+	notify -batch 500ms -include '*.go' -c 'gofmt -l {{range .Paths}}{{.}} {{end}}'
+
+The -debounce flag makes notify wait until no new events were received
+for a path during the given duration, before the handlers are run.
+All the events received for the path in the meantime are coalesced
+into a single one.
+
+The -include and -exclude flags filter events by the path. Both flags
+can be repeated. A pattern prefixed with "re:" is a regular expression
+matched against the absolute path, otherwise it is a glob pattern. Glob
+patterns containing a slash are matched against the path relative to
+the watched directory, other ones are matched against each path element.
+An event is handled when its path does not match any of the -exclude
+patterns and matches one of the -include patterns, if any were given.
+
+The -notifyignore flag makes notify read .notifyignore file from each
+of the watched directories. The file uses the gitignore syntax.
+
+The -json flag makes notify print each event to os.Stdout as a single
+line JSON object, with the path, the event values, the time, the watched
+directory and, if the file still exists, its size, mode and modification
+time.
+
+The -poll flag makes notify poll the paths for changes with the given
+interval instead of listening on them, which is useful on network and
+FUSE filesystems or bind mounts, where filesystem events are not
+delivered. Create, write, remove and rename events are synthesized by
+comparing size, modification time and inode of the files between polls.
+The -poll-fallback flag makes notify poll only the paths it failed to
+listen on, with the -poll interval or every second. In the -config file
+the flags are set per watch with the poll and poll-fallback keys.
+
+The -state flag makes notify keep a snapshot of the watched trees, with
+the size, modification time and inode of each file, in the given file.
+The snapshot is saved on exit and every -state-interval (1m by default).
+On start the snapshot is compared with the current state of the trees
+and events for the differences are handled before the received ones.
+They are never dropped by the -queue policy; notify waits for the busy
+handlers instead.
+The -state-hash flag adds SHA-256 hashes of the files to the snapshot,
+so only files with changed content are reported as written.
+
+The -once flag makes notify exit after the first event, which passed the
+filters, was handled. If no handler is specified the path of the event is
+printed to os.Stdout. The exit status is 0, or 1 if the handler's command
+failed. The -timeout flag, which requires -once, makes notify exit with
+status 2 when no event was handled within the given duration.
+
+	notify -once -e create -include '*.tar.gz' -timeout 10m dist/
+
+The -serve flag makes notify serve events over HTTP on the given address,
+e.g. -serve :8080. The /events endpoint streams the events as Server-Sent
+Events and the /ws endpoint streams them over WebSocket, each event being
+the JSON object printed with the -json flag. Both endpoints accept path
+and kind query parameters, which can be repeated: the path parameter is a
+path prefix or a glob pattern, the kind parameter is a comma-separated list
+of event values, e.g. /events?path=*.css&kind=create,write. The /status
+endpoint serves a JSON object with the number of events, sent and dropped
+messages and connected clients.
+
+The -record flag appends each received event to the given file, as the
+JSON object printed with the -json flag. The -replay flag reads events
+recorded in the given file and passes them to the handlers instead of
+listening on the paths; notify exits after all of them were handled.
+Events are replayed with the recorded intervals, which are scaled by
+the -speed flag, e.g. -speed 2x replays events twice as fast and -speed 0
+replays them without delays. Filters, the -e and -debounce flags apply to
+the replayed events as to the received ones. Replayed events are never
+dropped by the -queue policy; notify waits for the busy handlers instead.
+
+The -config flag reads watches from the given YAML or JSON file instead
+of the command line. Each of the watches has its own paths, events,
+filters, debounce duration, polling, working directory, environment and
+handlers.
+Relative paths are resolved against the directory of the file. Handler
+options are named after their flags, except for the -on flag, which is
+named events as for the watch. The -config flag cannot be used
+together with path arguments, handler flags or the -e, -include, -exclude,
+-notifyignore, -debounce, -poll and -poll-fallback flags, which are set
+per watch in the file instead.
+
+	watches:
+	- paths: [./src/...]
+	  events: create,write
+	  include: ["*.go"]
+	  exclude: [.git, "re:_test\\.go$"]
+	  notifyignore: true
+	  debounce: 500ms
+	  dir: ./src
+	  env:
+	    GOFLAGS: -mod=vendor
+	  handlers:
+	  - command: go test ./...
+	    queue: latest
+	  - file: ./lint.tmpl
+	    events: create
+	    j: 4
+
+On SIGINT or SIGTERM notify stops listening on the paths and waits for the
+handlers to handle queued events for up to the duration set with the
+-shutdown-timeout flag (10s by default). If the handlers do not finish in
+time, or the signal is received again, the queued events are dropped and
+the signal is forwarded to the process groups of the running commands,
+which are killed if they do not exit within the -grace period. The exit
+status is 0 if all the events were handled, or 128 plus the signal number
+if the handlers were cancelled.
+
+Handler files registered with -f and the -config file are watched for
+changes and reloaded without restarting notify. When a file fails to parse
+the previous version is kept and the error is logged. Sending SIGHUP forces
+a reload. Changes to the configuration other than handler templates
+require a restart.
+
 The path argument tells notify which director or directories to
 listen on. By default notify listens recursively in current working
 directory.
@@ -113,10 +544,30 @@ directory.
 If no handler is specified notify prints each event to os.Stdout.`
 
 var (
-	file    string
-	command string
-	paths   = []string{"." + string(os.PathSeparator) + "..."}
-	env     = newenv()
+	specs    []*handlerSpec
+	defaults = handlerOptions{
+		Queue:     policyDrop,
+		QueueSize: 64,
+		Jobs:      1,
+		Grace:     5 * time.Second,
+		Backoff:   time.Second,
+	}
+	mask     = events(notify.All)
+	debounce time.Duration
+	filters  filter
+	ignored  bool
+	jsonOut  bool
+	config   string
+	serve    string
+	once     bool
+	timeout  time.Duration
+	poll     time.Duration
+	fallback bool
+	record   string
+	replay   string
+	speedup  = speed(1)
+	paths    = []string{"." + string(os.PathSeparator) + "..."}
+	env      = newenv()
 )
 
 var mapping = map[notify.Event]string{
@@ -126,79 +577,126 @@ var mapping = map[notify.Event]string{
 	notify.Write:  "write",
 }
 
-func newenv() func(Event) []string {
-	env := os.Environ()
-	for i, s := range env {
-		s = strings.ToLower(s)
-		if strings.Contains(s, "NOTIFY_PATH=") || strings.Contains(s, "NOTIFY_EVENT=") {
-			env[i], env = env[len(env)-1], env[:len(env)-1]
+// events is a flag.Value, which parses comma-separated list of event values.
+type events notify.Event
+
+func (e *events) String() string {
+	var s []string
+	for _, name := range []string{"create", "remove", "rename", "write"} {
+		if notify.Event(*e)&kind(name) != 0 {
+			s = append(s, name)
 		}
 	}
-	env = append(env, "", "")
-	return func(e Event) []string {
-		s := make([]string, len(env))
-		copy(s, env)
-		s[len(s)-1] = "NOTIFY_EVENT=" + e.Event
-		s[len(s)-2] = "NOTIFY_PATH=" + e.Path
-		return s
-	}
+	return strings.Join(s, ",")
 }
 
-type handler struct {
-	tmpl *template.Template
-	env  []string
+func (e *events) Set(s string) error {
+	var ev notify.Event
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if name == "all" {
+			ev |= notify.All
+			continue
+		}
+		k := kind(name)
+		if k == 0 {
+			return fmt.Errorf("unknown event %q", name)
+		}
+		ev |= k
+	}
+	*e = events(ev)
+	return nil
 }
 
-func newHandler(text string) (*handler, error) {
-	tmpl, err := template.New("main.Handler").Parse(text)
-	if err != nil {
-		return nil, err
-	}
-	h := &handler{
-		tmpl: tmpl,
-		env:  env(Event{}),
+// kind gives the event for the given event value, as listed in mapping.
+func kind(name string) notify.Event {
+	for ev, s := range mapping {
+		if s == name {
+			return ev
+		}
 	}
-	return h, nil
+	return 0
 }
 
-func (h *handler) Run(e Event) error {
-	var buf bytes.Buffer
-	if err := h.tmpl.Execute(&buf, e); err != nil {
-		return err
-	}
-	name, args := cmd.Split(buf.String())
-	cmd := exec.Command(name, args...)
-	h.env[len(h.env)-1] = "NOTIFY_EVENT=" + e.Event
-	h.env[len(h.env)-2] = "NOTIFY_PATH=" + e.Path
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	cmd.Env = h.env
-	return cmd.Run()
+func newenv() func(Event) []string {
+	var env []string
+	for _, s := range os.Environ() {
+		if name := strings.SplitN(s, "=", 2)[0]; !contains(envNames, name) {
+			env = append(env, s)
+		}
+	}
+	return func(e Event) []string {
+		s := make([]string, len(env), len(env)+len(envNames))
+		copy(s, env)
+		return append(s,
+			"NOTIFY_PATH="+e.Path,
+			"NOTIFY_EVENT="+e.Event,
+			"NOTIFY_KINDS="+strings.Join(e.Kinds, ","),
+			"NOTIFY_DIR="+e.Dir,
+			"NOTIFY_BASE="+e.Base,
+			"NOTIFY_EXT="+e.Ext,
+			"NOTIFY_REL="+e.Rel,
+			"NOTIFY_ROOT="+e.Root,
+			"NOTIFY_TIME="+e.Time.Format(time.RFC3339Nano),
+			"NOTIFY_OLDPATH="+e.OldPath,
+			"NOTIFY_SEQ="+strconv.FormatUint(e.Seq, 10),
+		)
+	}
 }
 
-func (h *handler) Daemon() chan<- Event {
-	c := make(chan Event)
-	go func() {
-		for e := range c {
-			if err := h.Run(e); err != nil {
-				log.Println("handler error:", err)
-			}
-		}
-	}()
-	return c
+// envNames lists environment variables set by notify for the handlers.
+var envNames = []string{
+	"NOTIFY_PATH",
+	"NOTIFY_EVENT",
+	"NOTIFY_KINDS",
+	"NOTIFY_DIR",
+	"NOTIFY_BASE",
+	"NOTIFY_EXT",
+	"NOTIFY_REL",
+	"NOTIFY_ROOT",
+	"NOTIFY_TIME",
+	"NOTIFY_OLDPATH",
+	"NOTIFY_SEQ",
 }
 
 type Event struct {
-	Path  string
-	Event string
+	Path    string
+	Event   string
+	Kinds   []string
+	Dir     string
+	Base    string
+	Ext     string
+	Rel     string
+	Root    string
+	Time    time.Time
+	OldPath string
+	Seq     uint64
+
+	batch []Event // events of the batch collected with the -batch flag
+	keep  bool    // whether the event is queued without dropping, like the missed ones
 }
 
+// seq is the sequence number of the last received event.
+var seq uint64
+
 // newEvent TODO(rjeczalik)
-func newEvent(ei notify.EventInfo) Event {
-	return Event{
+func newEvent(ei notify.EventInfo, wp *watchpoint) Event {
+	e := mapping[ei.Event()]
+	ev := Event{
 		Path:  ei.Path(),
-		Event: mapping[ei.Event()],
+		Event: e,
+		Kinds: []string{e},
+		Dir:   filepath.Dir(ei.Path()),
+		Base:  filepath.Base(ei.Path()),
+		Ext:   filepath.Ext(ei.Path()),
+		Time:  time.Now(),
+		Seq:   atomic.AddUint64(&seq, 1),
 	}
+	if wp != nil {
+		ev.Rel = filepath.FromSlash(wp.rel(ev.Path))
+		ev.Root = wp.Root
+	}
+	return ev
 }
 
 func die(v interface{}) {
@@ -210,53 +708,245 @@ func init() {
 	flag.CommandLine.Usage = func() {
 		fmt.Fprintln(os.Stderr, usage)
 	}
-	flag.StringVar(&file, "f", "", "script file to execute on received event")
-	flag.StringVar(&command, "c", "", "command to run on received event")
+	flag.Var(handlerFlag{file: true}, "f", "script file to execute on received event")
+	flag.Var(handlerFlag{}, "c", "command to run on received event")
+	flag.Var(optionFlag(setEvents), "on", "comma-separated events the handler is run for")
+	flag.Var(optionFlag(setPolicy), "queue", "queue policy for events received when the handler is busy")
+	flag.Var(optionFlag(setQueueSize), "queue-size", "max number of events queued for the handler")
+	flag.Var(optionFlag(setJobs), "j", "max number of commands the handler runs at once")
+	flag.Var(boolOptionFlag(setRestart), "restart", "restart running command when new event is received")
+	flag.Var(optionFlag(setGrace), "grace", "time given to the command to exit after SIGTERM")
+	flag.Var(shellFlag{}, "shell", "run the handler's script with the given or default shell")
+	flag.Var(optionFlag(setRetry), "retry", "number of times the failed command is retried")
+	flag.Var(optionFlag(setBackoff), "backoff", "delay before the first retry, doubled for each next one")
+	flag.Var(optionFlag(setOnFailure), "on-failure", "command to run when the handler fails")
+	flag.Var(optionFlag(setMaxFailures), "max-failures", "number of consecutive failures, which stops notify")
+	flag.Var(optionFlag(setDir), "dir", "working directory of the handler's command")
+	flag.Var(optionFlag(setEnvFile), "env-file", "read environment of the handler's command from the dotenv file")
+	flag.Var(optionFlag(setEnv), "env", "set KEY=VALUE in environment of the handler's command")
+	flag.Var(optionFlag(setRunTimeout), "run-timeout", "terminate the handler's command running longer than the duration")
+	flag.Var(optionFlag(setBatch), "batch", "run the handler once for events received within the window")
+	flag.Var(&mask, "e", "comma-separated events to listen on")
+	flag.Var(&filters.include, "include", "handle only events for paths matching the pattern")
+	flag.Var(&filters.exclude, "exclude", "ignore events for paths matching the pattern")
+	flag.BoolVar(&ignored, "notifyignore", false, "read ignore patterns from .notifyignore files")
+	flag.StringVar(&config, "config", "", "configuration file with watches and handlers")
+	flag.BoolVar(&jsonOut, "json", false, "print each event as JSON object")
+	flag.DurationVar(&poll, "poll", 0, "poll the paths for changes with the interval")
+	flag.BoolVar(&fallback, "poll-fallback", false, "poll the paths notify fails to watch")
+	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", shutdownTimeout, "time given to the handlers to finish after SIGINT or SIGTERM")
+	flag.StringVar(&statePath, "state", "", "keep snapshot of the watched trees in the file")
+	flag.BoolVar(&stateHash, "state-hash", false, "compare content hashes of the files in the snapshot")
+	flag.DurationVar(&stateInterval, "state-interval", stateInterval, "interval the snapshot is saved with")
+	flag.BoolVar(&once, "once", false, "exit after the first event was handled")
+	flag.DurationVar(&timeout, "timeout", 0, "exit with non-zero status when no event was handled within the duration")
+	flag.StringVar(&serve, "serve", "", "serve events over HTTP on the address")
+	flag.StringVar(&record, "record", "", "append received events to the file")
+	flag.StringVar(&replay, "replay", "", "replay events recorded in the file")
+	flag.Var(&speedup, "speed", "replay speed")
+	flag.DurationVar(&debounce, "debounce", 0, "coalesce events received for a path within the duration")
+}
+
+// watchFlag gives the name of a handler or watch flag given on the command
+// line, which the -config file sets per watch instead.
+func watchFlag() (name string) {
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Value.(type) {
+		case handlerFlag, optionFlag, boolOptionFlag, shellFlag:
+			name = f.Name
+		}
+		switch f.Name {
+		case "e", "include", "exclude", "notifyignore", "debounce", "poll", "poll-fallback":
+			name = f.Name
+		}
+	})
+	return name
+}
+
+// errTimeout is reported when no event was handled within the -timeout.
+var errTimeout = errors.New("timed out waiting for an event")
+
+func main() {
 	flag.Parse()
 	if flag.NArg() != 0 {
 		paths = flag.Args()
 	}
-}
-
-func main() {
-	var handlers []*handler
-	if command != "" {
-		h, err := newHandler(command)
+	if timeout > 0 && !once {
+		die("the -timeout flag requires the -once flag")
+	}
+	var watches []*watch
+	if config != "" {
+		if len(specs) != 0 || flag.NArg() != 0 {
+			die("the -config flag cannot be used with handlers or paths")
+		}
+		if name := watchFlag(); name != "" {
+			die("the -config flag cannot be used with -" + name)
+		}
+		w, err := loadConfig(config)
 		if err != nil {
 			die(err)
 		}
-		handlers = append(handlers, h)
-	}
-	if file != "" {
-		p, err := ioutil.ReadFile(file)
+		watches = w
+	} else {
+		w, err := newWatch(paths, ignored)
 		if err != nil {
 			die(err)
 		}
-		h, err := newHandler(string(p))
+		w.events = notify.Event(mask)
+		w.filter = filters
+		w.debounce = debounce
+		w.poll = poll
+		w.fallback = fallback
+		for _, spec := range specs {
+			h, err := spec.handler()
+			if err != nil {
+				die(err)
+			}
+			w.handlers = append(w.handlers, h)
+		}
+		watches = append(watches, w)
+	}
+	for _, w := range watches {
+		w.replayFile = replay
+		w.speed = speedup
+	}
+	var own []string
+	if statePath != "" {
+		own = append(own, statePath, statePath+".tmp")
+	}
+	if record != "" {
+		own = append(own, record)
+	}
+	for _, file := range own {
+		if err := addOwnFile(file); err != nil {
+			die(err)
+		}
+	}
+	var st *state
+	if statePath != "" {
+		if replay != "" {
+			die("the -state flag cannot be used with -replay")
+		}
+		st = newState(statePath, stateHash, watches)
+		if err := st.Restore(); err != nil {
+			die(err)
+		}
+	}
+	if record != "" {
+		r, err := newRecorder(record)
 		if err != nil {
 			die(err)
 		}
-		handlers = append(handlers, h)
+		rec = r
 	}
-	var run []chan<- Event
-	for _, h := range handlers {
-		run = append(run, h.Daemon())
+	for _, w := range watches {
+		if err := w.Start(); err != nil {
+			die(err)
+		}
 	}
-	c := make(chan notify.EventInfo, 1)
-	for _, path := range paths {
-		if err := notify.Watch(path, c, notify.All); err != nil {
+	if serve != "" {
+		if err := listen(serve); err != nil {
 			die(err)
 		}
 	}
-	for ei := range c {
-		log.Println("received", ei)
-		e := newEvent(ei)
-		for _, run := range run {
-			select {
-			case run <- e:
-			default:
-				log.Println("event dropped due to slow handler")
+	r, err := newReloader(config, watches)
+	if err != nil {
+		die(err)
+	}
+	if err := r.Start(); err != nil {
+		die(err)
+	}
+	stop := make(chan struct{})
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go r.Run(hup, stop)
+	if st != nil {
+		go st.Run(stateInterval, stop)
+	}
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	var expired <-chan time.Time
+	if timeout > 0 {
+		expired = time.After(timeout)
+	}
+	var stopped os.Signal
+	go func() {
+		var s os.Signal
+		select {
+		case s = <-sig:
+			stopped = s
+			log.Printf("received %s, shutting down", s)
+		case <-done:
+		case <-expired:
+			if first() {
+				err = errTimeout
+				log.Println(err)
+			}
+		case err = <-fatal:
+			log.Println(err)
+		}
+		close(stop)
+		for _, w := range watches {
+			w.Stop()
+		}
+		if server != nil {
+			server.Close()
+		}
+		if s == nil {
+			// Handlers stopped without a signal are given all the time
+			// they need, unless a signal is received in the meantime.
+			s = <-sig
+			log.Printf("received %s, shutting down", s)
+		}
+		shutdown(watches, s, sig)
+	}()
+	var wg sync.WaitGroup
+	for _, w := range watches {
+		wg.Add(1)
+		go func(w *watch) {
+			defer wg.Done()
+			w.Run()
+		}(w)
+	}
+	wg.Wait()
+	for _, w := range watches {
+		for _, h := range w.handlers {
+			h.Wait()
+		}
+	}
+	if st != nil {
+		if err := st.Save(); err != nil {
+			log.Println("state error:", err)
+		}
+	}
+	if rec != nil {
+		if err := rec.Close(); err != nil {
+			log.Println("record error:", err)
+		}
+	}
+	for _, w := range watches {
+		for _, h := range w.handlers {
+			if n := h.queue.Dropped(); n != 0 {
+				log.Printf("handler %q dropped %d events", h.name, n)
+			}
+		}
+	}
+	if err == errTimeout {
+		os.Exit(2)
+	}
+	if once {
+		for _, w := range watches {
+			for _, h := range w.handlers {
+				if h.failing() {
+					err = fmt.Errorf("handler %q failed", h.name)
+				}
 			}
 		}
 	}
+	if err != nil {
+		os.Exit(1)
+	}
+	if stopped != nil {
+		os.Exit(exitCode(stopped))
+	}
 }
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rjeczalik/notify"
+)
+
+// defaultPoll is the polling interval used when falling back to polling
+// and no interval was given.
+const defaultPoll = time.Second
+
+// fileState is a snapshot of a single file, compared between polls.
+type fileState struct {
+	size  int64
+	mtime time.Time
+	ino   uint64
+	dir   bool
+	hash  string
+}
+
+// pollEvent is an event synthesized by the poller.
+type pollEvent struct {
+	path    string
+	event   notify.Event
+	oldPath string
+}
+
+var _ notify.EventInfo = pollEvent{}
+
+func (e pollEvent) Event() notify.Event { return e.event }
+func (e pollEvent) Path() string        { return e.path }
+func (e pollEvent) Sys() interface{}    { return nil }
+func (e pollEvent) String() string      { return fmt.Sprintf("%v: %q", e.event, e.path) }
+
+// poller synthesizes events for watchpoints by walking them periodically
+// and comparing size, modification time and inode of their files.
+type poller struct {
+	wps  []*watchpoint
+	snap map[string]fileState
+}
+
+func newPoller(wps []*watchpoint) *poller {
+	p := &poller{wps: wps}
+	p.snap = p.scan()
+	return p
+}
+
+func (p *poller) scan() map[string]fileState {
+	snap := make(map[string]fileState)
+	for _, wp := range p.wps {
+		scan(snap, wp, false)
+	}
+	return snap
+}
+
+// scan walks the watchpoint and adds states of its files to the snapshot,
+// skipping the files written by notify itself. If hash is true, states
+// of regular files have their content hash set.
+func scan(snap map[string]fileState, wp *watchpoint, hash bool) {
+	recursive := strings.HasSuffix(wp.Path, "...")
+	add := func(path string, fi os.FileInfo) {
+		st := newFileState(fi)
+		if hash && fi.Mode().IsRegular() {
+			st.hash = hashFile(path)
+		}
+		snap[path] = st
+	}
+	filepath.Walk(wp.Root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if path == wp.Root {
+			if !fi.IsDir() {
+				add(path, fi)
+			}
+			return nil
+		}
+		if fi.IsDir() && wp.ignore != nil && wp.ignore.Match(wp.rel(path), true) {
+			return filepath.SkipDir
+		}
+		if ownFiles[path] {
+			return nil
+		}
+		add(path, fi)
+		if fi.IsDir() && !recursive {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+}
+
+// changed reports whether the file was written. If both states have
+// content hashes, only the hashes and sizes are compared.
+func (st fileState) changed(cur fileState) bool {
+	if st.size != cur.size {
+		return true
+	}
+	if st.hash != "" && cur.hash != "" {
+		return st.hash != cur.hash
+	}
+	return !st.mtime.Equal(cur.mtime) || st.ino != cur.ino
+}
+
+// hashFile gives hex-encoded SHA-256 of the file's content, or an empty
+// string if the file could not be read.
+func hashFile(path string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func newFileState(fi os.FileInfo) fileState {
+	return fileState{
+		size:  fi.Size(),
+		mtime: fi.ModTime(),
+		ino:   inode(fi),
+		dir:   fi.IsDir(),
+	}
+}
+
+// Poll walks the watchpoints and gives events for the changes since
+// the previous poll.
+func (p *poller) Poll() []pollEvent {
+	snap := p.scan()
+	events := diff(p.snap, snap)
+	p.snap = snap
+	return events
+}
+
+// diff gives events for the changes between the old and the new snapshot.
+// Files are compared by their hashes, if both snapshots have them. A file
+// which was removed and created under another path with the same inode,
+// and was not changed otherwise, is reported as renamed.
+func diff(old, snap map[string]fileState) []pollEvent {
+	var removed, created, written []string
+	for path, prev := range old {
+		cur, ok := snap[path]
+		switch {
+		case !ok:
+			removed = append(removed, path)
+		case prev.dir != cur.dir:
+			removed = append(removed, path)
+			created = append(created, path)
+		case !cur.dir && prev.changed(cur):
+			written = append(written, path)
+		}
+	}
+	for path := range snap {
+		if _, ok := old[path]; !ok {
+			created = append(created, path)
+		}
+	}
+	sort.Strings(removed)
+	sort.Strings(created)
+	sort.Strings(written)
+	inodes := make(map[uint64]string) // removed paths by inode
+	for _, path := range removed {
+		if ino := old[path].ino; ino != 0 {
+			inodes[ino] = path
+		}
+	}
+	moved := make(map[string]string) // old paths by new path
+	renamed := make(map[string]bool)
+	for _, path := range created {
+		cur := snap[path]
+		if prev, ok := inodes[cur.ino]; ok && cur.ino != 0 && prev != path && !old[prev].changed(cur) {
+			moved[path] = prev
+			renamed[prev] = true
+		}
+	}
+	var events []pollEvent
+	for _, path := range removed {
+		e := pollEvent{path: path, event: notify.Remove}
+		if renamed[path] {
+			e.event = notify.Rename
+		}
+		events = append(events, e)
+	}
+	for _, path := range created {
+		events = append(events, pollEvent{path: path, event: notify.Create, oldPath: moved[path]})
+	}
+	for _, path := range written {
+		events = append(events, pollEvent{path: path, event: notify.Write})
+	}
+	return events
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDiff(t *testing.T) {
+	t0, t1 := time.Unix(1, 0), time.Unix(2, 0)
+	file := fileState{size: 1, mtime: t0, ino: 5}
+	cases := [...]struct {
+		old    map[string]fileState
+		snap   map[string]fileState
+		events []string
+	}{
+		0: {map[string]fileState{"a": file}, map[string]fileState{"a": file}, nil},
+		1: {nil, map[string]fileState{"a": file}, []string{"notify.Create a"}},
+		2: {map[string]fileState{"a": file}, nil, []string{"notify.Remove a"}},
+		3: {
+			map[string]fileState{"a": file},
+			map[string]fileState{"a": {size: 2, mtime: t0, ino: 5}},
+			[]string{"notify.Write a"},
+		},
+		4: {
+			map[string]fileState{"a": file},
+			map[string]fileState{"a": {size: 1, mtime: t1, ino: 5}},
+			[]string{"notify.Write a"},
+		},
+		5: {
+			map[string]fileState{"a": {size: 1, mtime: t0, hash: "x"}},
+			map[string]fileState{"a": {size: 1, mtime: t1, hash: "x"}},
+			nil,
+		},
+		6: {
+			map[string]fileState{"a": {size: 1, mtime: t0, hash: "x"}},
+			map[string]fileState{"a": {size: 1, mtime: t0, hash: "y"}},
+			[]string{"notify.Write a"},
+		},
+		7: {
+			map[string]fileState{"a": {mtime: t0, ino: 5, dir: true}},
+			map[string]fileState{"a": file},
+			[]string{"notify.Remove a", "notify.Create a"},
+		},
+		8: {
+			map[string]fileState{"a": {mtime: t0, ino: 5, dir: true}},
+			map[string]fileState{"a": {mtime: t1, ino: 5, dir: true}},
+			nil,
+		},
+		9: {
+			map[string]fileState{"a": file},
+			map[string]fileState{"b": file},
+			[]string{"notify.Rename a", "notify.Create b a"},
+		},
+		10: {
+			map[string]fileState{"a": file},
+			map[string]fileState{"b": {size: 2, mtime: t0, ino: 5}},
+			[]string{"notify.Remove a", "notify.Create b"},
+		},
+		11: {
+			map[string]fileState{"a": {size: 1, mtime: t0}},
+			map[string]fileState{"b": {size: 1, mtime: t0}},
+			[]string{"notify.Remove a", "notify.Create b"},
+		},
+	}
+	for i, cas := range cases {
+		var events []string
+		for _, e := range diff(cas.old, cas.snap) {
+			s := fmt.Sprintf("%v %s", e.event, e.path)
+			if e.oldPath != "" {
+				s += " " + e.oldPath
+			}
+			events = append(events, s)
+		}
+		if !equal(events, cas.events) {
+			t.Errorf("want events=%v; got %v (i=%d)", cas.events, events, i)
+		}
+	}
+}
+
+func TestScanOwnFiles(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a.txt", ".notify-state", ".notify-state.tmp"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(name), 0644); err != nil {
+			t.Fatalf("WriteFile()=%v", err)
+		}
+	}
+	for _, name := range []string{".notify-state", ".notify-state.tmp"} {
+		if err := addOwnFile(filepath.Join(dir, name)); err != nil {
+			t.Fatalf("addOwnFile()=%v", err)
+		}
+	}
+	defer func() { ownFiles = make(map[string]bool) }()
+	wp, err := newWatchpoint(filepath.Join(dir, "..."))
+	if err != nil {
+		t.Fatalf("newWatchpoint()=%v", err)
+	}
+	snap := make(map[string]fileState)
+	scan(snap, wp, false)
+	if len(snap) != 1 {
+		t.Fatalf("want 1 file in snapshot; got %v", snap)
+	}
+	if _, ok := snap[filepath.Join(dir, "a.txt")]; !ok {
+		t.Errorf("want a.txt in snapshot; got %v", snap)
+	}
+}
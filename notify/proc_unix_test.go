@@ -0,0 +1,76 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// waitLines waits until the file has the given number of lines.
+func waitLines(t *testing.T, file string, n int) {
+	for i := 0; i < 100; i++ {
+		if p, err := ioutil.ReadFile(file); err == nil && strings.Count(string(p), "\n") >= n {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("want %d lines in %s", n, file)
+}
+
+func TestHandlerRestart(t *testing.T) {
+	cases := [...]struct {
+		trap string
+		runs []string
+	}{
+		// The command exits on SIGTERM.
+		0: {"sleep 0.2; echo term $REL >> $OUT; exit 0", []string{"start a", "term a", "start c", "done c"}},
+		// The command ignores SIGTERM and is killed after the grace period.
+		1: {"", []string{"start a", "start c", "done c"}},
+	}
+	for i, cas := range cases {
+		dir := t.TempDir()
+		out := filepath.Join(dir, "out")
+		text := "OUT=" + shellquote(out) + "; REL={{.Rel}}; echo start $REL >> $OUT; trap '" + cas.trap + "' TERM; " +
+			"sleep {{if eq .Rel \"a\"}}10{{else}}0{{end}} & echo $! > " + shellquote(dir) + "/{{.Rel}}.pid; wait; " +
+			"echo done $REL >> $OUT"
+		h := newShellHandler(t, text, handlerOptions{Restart: true, Grace: 300 * time.Millisecond})
+		h.Daemon()
+		h.Send(Event{Path: filepath.Join(dir, "a"), Rel: "a"})
+		waitLines(t, out, 1)
+		// Wait for the trap to be set, before sending the next events.
+		time.Sleep(100 * time.Millisecond)
+		h.Send(Event{Path: filepath.Join(dir, "b"), Rel: "b"})
+		h.Send(Event{Path: filepath.Join(dir, "c"), Rel: "c"})
+		waitLines(t, out, len(cas.runs))
+		h.Close()
+		h.Wait()
+		if got := readLines(t, out); !equal(got, cas.runs) {
+			t.Errorf("want runs=%q; got %q (i=%d)", cas.runs, got, i)
+		}
+		p, err := ioutil.ReadFile(filepath.Join(dir, "a.pid"))
+		if err != nil {
+			t.Fatalf("ReadFile()=%v (i=%d)", err, i)
+		}
+		pid, err := strconv.Atoi(strings.TrimSpace(string(p)))
+		if err != nil {
+			t.Fatalf("Atoi()=%v (i=%d)", err, i)
+		}
+		// The killed process may be briefly left as a zombie, until its new
+		// parent reaps it.
+		for j := 0; j < 100 && err != syscall.ESRCH; j++ {
+			if err = syscall.Kill(pid, 0); err != syscall.ESRCH {
+				time.Sleep(20 * time.Millisecond)
+			}
+		}
+		if err != syscall.ESRCH {
+			t.Errorf("want sleep of the first command terminated; got %v (i=%d)", err, i)
+		}
+	}
+}
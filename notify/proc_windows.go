@@ -0,0 +1,20 @@
+package main
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// setpgid makes the command run in its own process group.
+func setpgid(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.CreationFlags |= syscall.CREATE_NEW_PROCESS_GROUP
+}
+
+// signalGroup kills the command, as Windows does not support sending
+// signals to processes.
+func signalGroup(cmd *exec.Cmd, _ syscall.Signal) error {
+	return cmd.Process.Kill()
+}
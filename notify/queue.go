@@ -0,0 +1,211 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+)
+
+// policy tells what happens with an event when the handler is busy.
+type policy string
+
+const (
+	policyDrop      policy = "drop"      // drop the event, unless the handler is idle
+	policyOldest    policy = "oldest"    // queue the event, drop the oldest one when full
+	policyUnbounded policy = "unbounded" // queue the event
+	policyBlock     policy = "block"     // queue the event, wait for the handler when full
+	policyLatest    policy = "latest"    // queue the event, replacing a queued one for the same path
+)
+
+func setPolicy(o *handlerOptions, s string) error {
+	switch p := policy(s); p {
+	case policyDrop, policyOldest, policyUnbounded, policyBlock, policyLatest:
+		o.Queue = p
+		return nil
+	default:
+		return fmt.Errorf("unknown queue policy %q", s)
+	}
+}
+
+func setQueueSize(o *handlerOptions, s string) error {
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return err
+	}
+	if n < 1 {
+		return fmt.Errorf("invalid queue size %d", n)
+	}
+	o.QueueSize = n
+	return nil
+}
+
+// queue buffers events for a handler according to its policy.
+type queue struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	policy  policy
+	size    int
+	events  []Event
+	running map[string]int
+	waiting int
+	wake    chan struct{}
+	closed  bool
+	dropped int
+}
+
+func newQueue(p policy, size int) *queue {
+	if p == "" {
+		p = policyDrop
+	}
+	q := &queue{
+		policy:  p,
+		size:    size,
+		running: make(map[string]int),
+		wake:    make(chan struct{}, 1),
+	}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+// Push adds the event to the queue. It returns false if any event was dropped.
+// Events, which are kept, are not dropped by the drop and oldest policies,
+// instead Push waits for the handler to take the queued events.
+func (q *queue) Push(e Event) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	defer q.cond.Broadcast()
+	if q.closed {
+		q.dropped++
+		return false
+	}
+	switch q.policy {
+	case policyDrop:
+		for e.keep && q.waiting <= len(q.events) && !q.closed {
+			q.cond.Wait()
+		}
+		if q.waiting <= len(q.events) {
+			q.dropped++
+			return false
+		}
+	case policyOldest:
+		for e.keep && len(q.events) >= q.size && !q.closed {
+			q.cond.Wait()
+		}
+		if len(q.events) >= q.size {
+			q.events = q.events[1:]
+			q.events = append(q.events, e)
+			q.dropped++
+			return false
+		}
+	case policyBlock:
+		for len(q.events) >= q.size && !q.closed {
+			q.cond.Wait()
+		}
+	case policyLatest:
+		for i := range q.events {
+			if q.events[i].Path == e.Path {
+				q.events[i] = e
+				return true
+			}
+		}
+	}
+	q.events = append(q.events, e)
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// Wake gives a channel, which receives a value after an event was queued.
+func (q *queue) Wake() <-chan struct{} {
+	return q.wake
+}
+
+// Len gives number of queued events.
+func (q *queue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.events)
+}
+
+// Squash drops all queued events but the most recent one.
+func (q *queue) Squash() {
+	q.mu.Lock()
+	if n := len(q.events); n > 1 {
+		q.events = append(q.events[:0], q.events[n-1])
+	}
+	q.mu.Unlock()
+}
+
+// Pop waits for an event to be queued. Events for a path, which is still
+// being handled, are skipped until Done is called for that path, so events
+// for the same path are handled in order. It returns false when the queue
+// was closed and no events are left.
+func (q *queue) Pop() (Event, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.waiting++
+	// Wake Push waiting for the handler to become idle.
+	q.cond.Broadcast()
+	i := q.next()
+	for i == -1 && !(q.closed && len(q.events) == 0) {
+		q.cond.Wait()
+		i = q.next()
+	}
+	q.waiting--
+	if i == -1 {
+		return Event{}, false
+	}
+	e := q.events[i]
+	q.events = append(q.events[:i], q.events[i+1:]...)
+	q.running[e.Path]++
+	q.cond.Broadcast()
+	return e, true
+}
+
+// Done marks the event returned by Pop as handled.
+func (q *queue) Done(e Event) {
+	q.mu.Lock()
+	if q.running[e.Path]--; q.running[e.Path] == 0 {
+		delete(q.running, e.Path)
+	}
+	q.mu.Unlock()
+	q.cond.Broadcast()
+}
+
+// next gives index of the first event for a path which is not being handled,
+// or -1 if there is no such event.
+func (q *queue) next() int {
+	for i, e := range q.events {
+		if q.running[e.Path] == 0 {
+			return i
+		}
+	}
+	return -1
+}
+
+// Close closes the queue. Events already queued are still returned by Pop.
+func (q *queue) Close() {
+	q.mu.Lock()
+	q.closed = true
+	q.mu.Unlock()
+	q.cond.Broadcast()
+}
+
+// Cancel closes the queue and drops the events, which are still queued.
+func (q *queue) Cancel() {
+	q.mu.Lock()
+	q.closed = true
+	q.dropped += len(q.events)
+	q.events = nil
+	q.mu.Unlock()
+	q.cond.Broadcast()
+}
+
+// Dropped gives number of events dropped so far.
+func (q *queue) Dropped() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.dropped
+}
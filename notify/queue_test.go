@@ -0,0 +1,232 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func ev(path string, seq uint64) Event {
+	return Event{Path: path, Event: "write", Kinds: []string{"write"}, Seq: seq}
+}
+
+func name(e Event) string {
+	return fmt.Sprintf("%s%d", e.Path, e.Seq)
+}
+
+// drain closes the queue and pops all the events left in it.
+func drain(q *queue) []string {
+	q.Close()
+	var names []string
+	for {
+		e, ok := q.Pop()
+		if !ok {
+			return names
+		}
+		q.Done(e)
+		names = append(names, name(e))
+	}
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// waitPop waits until the given number of goroutines wait in Pop.
+func waitPop(t *testing.T, q *queue, n int) {
+	for i := 0; i < 100; i++ {
+		q.mu.Lock()
+		waiting := q.waiting
+		q.mu.Unlock()
+		if waiting == n {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("want %d goroutines waiting in Pop", n)
+}
+
+func TestQueuePolicy(t *testing.T) {
+	cases := [...]struct {
+		policy  policy
+		size    int
+		push    []string
+		ok      []bool
+		popped  []string
+		dropped int
+	}{
+		0: {policyDrop, 0, []string{"a", "b"}, []bool{false, false}, nil, 2},
+		1: {policyOldest, 2, []string{"a", "b", "c"}, []bool{true, true, false}, []string{"b2", "c3"}, 1},
+		2: {policyUnbounded, 0, []string{"a", "b", "c"}, []bool{true, true, true}, []string{"a1", "b2", "c3"}, 0},
+		3: {policyBlock, 3, []string{"a", "b", "c"}, []bool{true, true, true}, []string{"a1", "b2", "c3"}, 0},
+		4: {policyLatest, 0, []string{"a", "b", "a"}, []bool{true, true, true}, []string{"a3", "b2"}, 0},
+		5: {"", 0, []string{"a"}, []bool{false}, nil, 1},
+	}
+	for i, cas := range cases {
+		q := newQueue(cas.policy, cas.size)
+		for j, path := range cas.push {
+			if ok := q.Push(ev(path, uint64(j+1))); ok != cas.ok[j] {
+				t.Errorf("want Push(%s)=%t; got %t (i=%d)", path, cas.ok[j], ok, i)
+			}
+		}
+		if popped := drain(q); !equal(popped, cas.popped) {
+			t.Errorf("want popped=%v; got %v (i=%d)", cas.popped, popped, i)
+		}
+		if n := q.Dropped(); n != cas.dropped {
+			t.Errorf("want dropped=%d; got %d (i=%d)", cas.dropped, n, i)
+		}
+	}
+}
+
+func TestQueueDropIdle(t *testing.T) {
+	q := newQueue(policyDrop, 0)
+	c := make(chan Event)
+	go func() {
+		e, _ := q.Pop()
+		c <- e
+	}()
+	waitPop(t, q, 1)
+	if !q.Push(ev("a", 1)) {
+		t.Fatal("want event queued for idle handler")
+	}
+	if q.Push(ev("b", 2)) {
+		t.Fatal("want event dropped for busy handler")
+	}
+	if e := <-c; name(e) != "a1" {
+		t.Fatalf("want a1; got %s", name(e))
+	}
+}
+
+func TestQueueBlock(t *testing.T) {
+	q := newQueue(policyBlock, 1)
+	q.Push(ev("a", 1))
+	pushed := make(chan bool)
+	go func() {
+		pushed <- q.Push(ev("b", 2))
+	}()
+	select {
+	case <-pushed:
+		t.Fatal("want Push blocked on full queue")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if e, _ := q.Pop(); name(e) != "a1" {
+		t.Fatalf("want a1; got %s", name(e))
+	}
+	if ok := <-pushed; !ok {
+		t.Fatal("want Push=true after Pop")
+	}
+	if popped := drain(q); !equal(popped, []string{"b2"}) {
+		t.Fatalf("want popped=[b2]; got %v", popped)
+	}
+}
+
+func TestQueueOrder(t *testing.T) {
+	q := newQueue(policyUnbounded, 0)
+	for i, path := range []string{"a", "b", "a"} {
+		q.Push(ev(path, uint64(i+1)))
+	}
+	a, _ := q.Pop()
+	if b, _ := q.Pop(); name(b) != "b2" {
+		t.Fatalf("want b2 popped while a is running; got %s", name(b))
+	}
+	c := make(chan Event)
+	go func() {
+		e, _ := q.Pop()
+		c <- e
+	}()
+	select {
+	case e := <-c:
+		t.Fatalf("want Pop blocked until a1 is done; got %s", name(e))
+	case <-time.After(50 * time.Millisecond):
+	}
+	q.Done(a)
+	if e := <-c; name(e) != "a3" {
+		t.Fatalf("want a3; got %s", name(e))
+	}
+}
+
+func TestQueueSquash(t *testing.T) {
+	q := newQueue(policyUnbounded, 0)
+	for i, path := range []string{"a", "b", "c"} {
+		q.Push(ev(path, uint64(i+1)))
+	}
+	q.Squash()
+	if n := q.Len(); n != 1 {
+		t.Fatalf("want Len()=1; got %d", n)
+	}
+	if popped := drain(q); !equal(popped, []string{"c3"}) {
+		t.Fatalf("want popped=[c3]; got %v", popped)
+	}
+}
+
+func TestQueueCancel(t *testing.T) {
+	q := newQueue(policyUnbounded, 0)
+	for i, path := range []string{"a", "b", "c"} {
+		q.Push(ev(path, uint64(i+1)))
+	}
+	q.Cancel()
+	if e, ok := q.Pop(); ok {
+		t.Fatalf("want Pop()=false after Cancel; got %s", name(e))
+	}
+	if q.Push(ev("d", 4)) {
+		t.Fatal("want Push()=false after Cancel")
+	}
+	if n := q.Dropped(); n != 4 {
+		t.Fatalf("want Dropped()=4; got %d", n)
+	}
+}
+
+func TestQueueKeep(t *testing.T) {
+	for _, p := range []policy{policyDrop, policyOldest} {
+		q := newQueue(p, 1)
+		if p == policyOldest {
+			q.Push(ev("a", 1))
+		}
+		e := ev("b", 2)
+		e.keep = true
+		pushed := make(chan bool)
+		go func() {
+			pushed <- q.Push(e)
+		}()
+		select {
+		case <-pushed:
+			t.Fatalf("want Push blocked for busy handler (policy=%s)", p)
+		case <-time.After(50 * time.Millisecond):
+		}
+		c := make(chan []string)
+		go func() {
+			var names []string
+			for {
+				e, ok := q.Pop()
+				if !ok {
+					c <- names
+					return
+				}
+				q.Done(e)
+				names = append(names, name(e))
+			}
+		}()
+		if ok := <-pushed; !ok {
+			t.Fatalf("want Push=true for idle handler (policy=%s)", p)
+		}
+		q.Close()
+		want := []string{"b2"}
+		if p == policyOldest {
+			want = []string{"a1", "b2"}
+		}
+		if popped := <-c; !equal(popped, want) {
+			t.Errorf("want popped=%v; got %v (policy=%s)", want, popped, p)
+		}
+		if n := q.Dropped(); n != 0 {
+			t.Errorf("want dropped=0; got %d (policy=%s)", n, p)
+		}
+	}
+}
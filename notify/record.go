@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// recorder appends received events to a file as JSON lines, in the format
+// printed with the -json flag.
+type recorder struct {
+	mu sync.Mutex
+	f  *os.File
+	w  *bufio.Writer
+}
+
+// rec records events when the -record flag is used.
+var rec *recorder
+
+func newRecorder(file string) (*recorder, error) {
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &recorder{f: f, w: bufio.NewWriter(f)}, nil
+}
+
+// Record writes the event to the file.
+func (r *recorder) Record(e Event) error {
+	p, err := json.Marshal(newJSONEvent(e))
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, err := r.w.Write(append(p, '\n')); err != nil {
+		return err
+	}
+	return r.w.Flush()
+}
+
+// Tee records each event received from in before forwarding it to
+// the returned channel.
+func (r *recorder) Tee(in <-chan Event) <-chan Event {
+	out := make(chan Event)
+	go func() {
+		for e := range in {
+			if err := r.Record(e); err != nil {
+				log.Println("record error:", err)
+			}
+			out <- e
+		}
+		close(out)
+	}()
+	return out
+}
+
+// Close closes the file.
+func (r *recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.w.Flush(); err != nil {
+		r.f.Close()
+		return err
+	}
+	return r.f.Close()
+}
+
+// speed is a flag value for the replay speed, e.g. 2x or 0.5.
+type speed float64
+
+func (s *speed) String() string {
+	return strconv.FormatFloat(float64(*s), 'g', -1, 64) + "x"
+}
+
+func (s *speed) Set(v string) error {
+	f, err := strconv.ParseFloat(strings.TrimSuffix(v, "x"), 64)
+	if err != nil {
+		return fmt.Errorf("invalid speed %q", v)
+	}
+	if f < 0 {
+		return errors.New("speed must not be negative")
+	}
+	*s = speed(f)
+	return nil
+}
+
+// delay scales the time between two recorded events. A zero speed
+// replays the events without delays.
+func (s speed) delay(d time.Duration) time.Duration {
+	if s == 0 || d <= 0 {
+		return 0
+	}
+	return time.Duration(float64(d) / float64(s))
+}
+
+// replayEvent converts a recorded event back to an Event.
+func replayEvent(v jsonEvent) Event {
+	e := Event{
+		Path:    v.Path,
+		Event:   v.Event,
+		Kinds:   v.Kinds,
+		Dir:     filepath.Dir(v.Path),
+		Base:    filepath.Base(v.Path),
+		Ext:     filepath.Ext(v.Path),
+		Rel:     v.Rel,
+		Root:    v.Root,
+		Time:    v.Time,
+		OldPath: v.OldPath,
+		Seq:     v.Seq,
+	}
+	if len(e.Kinds) == 0 {
+		e.Kinds = []string{e.Event}
+	}
+	return e
+}
+
+// replay reads events recorded in the file and sends them to the given
+// channel, keeping the recorded intervals scaled by the speed. The channel
+// is closed after all the events were sent or the watch was stopped.
+func (w *watch) replay(events chan<- Event) {
+	defer close(events)
+	f, err := os.Open(w.replayFile)
+	if err != nil {
+		log.Println("replay error:", err)
+		return
+	}
+	defer f.Close()
+	var (
+		last time.Time
+		dec  = json.NewDecoder(bufio.NewReader(f))
+	)
+	for n := 1; ; n++ {
+		var v jsonEvent
+		if err := dec.Decode(&v); err != nil {
+			if err != io.EOF {
+				log.Printf("replay error: %s: event %d: %s", w.replayFile, n, err)
+			}
+			return
+		}
+		if d := w.speed.delay(v.Time.Sub(last)); !last.IsZero() && d > 0 {
+			t := time.NewTimer(d)
+			select {
+			case <-t.C:
+			case <-w.c:
+				t.Stop()
+				return
+			}
+		}
+		last = v.Time
+		e := replayEvent(v)
+		if !w.filter.match(lookup(w.wps, e.Path), e.Path) {
+			continue
+		}
+		if w.events&kind(e.Event) == 0 {
+			continue
+		}
+		log.Printf("replayed %s: %q", e.Event, e.Path)
+		// Replayed events are not dropped by the handlers, so the replay
+		// gives the same runs regardless of the speed.
+		e.keep = true
+		select {
+		case events <- e:
+		case <-w.c:
+			return
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestSpeedDelay(t *testing.T) {
+	cases := [...]struct {
+		speed speed
+		d     time.Duration
+		delay time.Duration
+	}{
+		0: {1, time.Second, time.Second},
+		1: {2, time.Second, 500 * time.Millisecond},
+		2: {0.5, time.Second, 2 * time.Second},
+		3: {0, time.Second, 0},
+		4: {1, -time.Second, 0},
+	}
+	for i, cas := range cases {
+		if delay := cas.speed.delay(cas.d); delay != cas.delay {
+			t.Errorf("want delay=%s; got %s (i=%d)", cas.delay, delay, i)
+		}
+	}
+}
+
+// TestReplayHandler records events and replays them to a handler, which
+// appends the events it was run for to a file.
+func TestReplayHandler(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("requires /bin/sh")
+	}
+	dir := t.TempDir()
+	record := filepath.Join(dir, "ev.jsonl")
+	out := filepath.Join(dir, "out")
+	r, err := newRecorder(record)
+	if err != nil {
+		t.Fatalf("newRecorder()=%v", err)
+	}
+	start := time.Now()
+	for i, e := range []struct{ event, rel string }{
+		{"create", "a.go"},
+		{"write", "a.go"},
+		{"remove", "b.go"},
+		{"write", "c.tmp"},
+		{"write", "d d.go"},
+	} {
+		path := filepath.Join(dir, e.rel)
+		err := r.Record(Event{
+			Path:  path,
+			Event: e.event,
+			Kinds: []string{e.event},
+			Rel:   e.rel,
+			Root:  dir,
+			Time:  start.Add(time.Duration(i) * time.Hour),
+			Seq:   uint64(i + 1),
+		})
+		if err != nil {
+			t.Fatalf("Record()=%v", err)
+		}
+	}
+	if err := r.Close(); err != nil {
+		t.Fatalf("Close()=%v", err)
+	}
+	w, err := newWatch([]string{filepath.Join(dir, "...")}, false)
+	if err != nil {
+		t.Fatalf("newWatch()=%v", err)
+	}
+	if err := w.filter.exclude.Set("*.tmp"); err != nil {
+		t.Fatalf("Set()=%v", err)
+	}
+	w.replayFile = record
+	var opts handlerOptions
+	if err := setEvents(&opts, "create,write"); err != nil {
+		t.Fatalf("setEvents()=%v", err)
+	}
+	// The handler is slow, so the events would be dropped with the default
+	// queue policy, if they were received.
+	h := newShellHandler(t, "sleep 0.05; echo {{.Event}} {{.Rel}} >> "+shellquote(out), opts)
+	w.handlers = append(w.handlers, h)
+	if err := w.Start(); err != nil {
+		t.Fatalf("Start()=%v", err)
+	}
+	w.Run()
+	h.Wait()
+	want := []string{"create a.go", "write a.go", "write d d.go"}
+	if got := readLines(t, out); !equal(got, want) {
+		t.Errorf("want runs=%q; got %q", want, got)
+	}
+	if n := h.queue.Dropped(); n != 0 {
+		t.Errorf("want dropped=0; got %d", n)
+	}
+	if h.failing() {
+		t.Error("want handler not failing")
+	}
+}
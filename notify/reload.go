@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/rjeczalik/notify"
+)
+
+// reloadDelay is the time the reloader waits after a file was changed,
+// so the file is not read while it is still being written.
+const reloadDelay = 100 * time.Millisecond
+
+// reloader reloads handler templates after their files or the configuration
+// file were changed.
+type reloader struct {
+	config  string
+	watches []*watch
+	files   map[string]struct{}
+	c       chan notify.EventInfo
+}
+
+func newReloader(config string, watches []*watch) (*reloader, error) {
+	r := &reloader{
+		config:  config,
+		watches: watches,
+		files:   make(map[string]struct{}),
+		c:       make(chan notify.EventInfo, 16),
+	}
+	var files []string
+	if config != "" {
+		files = append(files, config)
+	}
+	for _, w := range watches {
+		for _, h := range w.handlers {
+			if h.file != "" {
+				files = append(files, h.file)
+			}
+		}
+	}
+	for _, file := range files {
+		abs, err := filepath.Abs(file)
+		if err != nil {
+			return nil, err
+		}
+		r.files[realpath(abs)] = struct{}{}
+	}
+	return r, nil
+}
+
+// Start starts watching the files. Directories of the files are watched,
+// as editors often replace a file instead of writing to it.
+func (r *reloader) Start() error {
+	dirs := make(map[string]struct{})
+	for file := range r.files {
+		dirs[filepath.Dir(file)] = struct{}{}
+	}
+	for dir := range dirs {
+		if err := notify.Watch(dir, r.c, notify.Create|notify.Write|notify.Rename); err != nil {
+			notify.Stop(r.c)
+			return err
+		}
+	}
+	return nil
+}
+
+// Run reloads the templates after any of the files was changed or a value
+// was received from the hup channel, until the stop channel is closed.
+func (r *reloader) Run(hup <-chan os.Signal, stop <-chan struct{}) {
+	var (
+		t *time.Timer
+		c <-chan time.Time
+	)
+	for {
+		select {
+		case ei := <-r.c:
+			if _, ok := r.files[ei.Path()]; !ok {
+				continue
+			}
+			if t == nil {
+				t = time.NewTimer(reloadDelay)
+			} else {
+				t.Reset(reloadDelay)
+			}
+			c = t.C
+		case <-c:
+			c = nil
+			r.Reload()
+		case <-hup:
+			r.Reload()
+		case <-stop:
+			notify.Stop(r.c)
+			return
+		}
+	}
+}
+
+// Reload reloads the templates. If the configuration file was used, it is
+// read again and the templates of its handlers are swapped. Other changes
+// to the configuration require restarting notify.
+func (r *reloader) Reload() {
+	if r.config == "" {
+		for _, w := range r.watches {
+			for _, h := range w.handlers {
+				if err := h.Reload(); err != nil {
+					log.Printf("reloading handler %q failed: %s", h.name, err)
+				} else if h.file != "" {
+					log.Printf("reloaded handler %q", h.name)
+				}
+			}
+		}
+		return
+	}
+	watches, err := loadConfig(r.config)
+	if err != nil {
+		log.Printf("reloading %s failed: %s", r.config, err)
+		return
+	}
+	if err := r.swap(watches); err != nil {
+		log.Printf("reloading %s failed: %s", r.config, err)
+		return
+	}
+	log.Printf("reloaded %s", r.config)
+}
+
+func (r *reloader) swap(watches []*watch) error {
+	if len(watches) != len(r.watches) {
+		return fmt.Errorf("number of watches changed, restart notify to apply")
+	}
+	for i, w := range watches {
+		if len(w.handlers) != len(r.watches[i].handlers) {
+			return fmt.Errorf("watches[%d]: number of handlers changed, restart notify to apply", i)
+		}
+	}
+	for i, w := range watches {
+		for j, h := range w.handlers {
+			r.watches[i].handlers[j].tmpl.Store(h.template())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestReloadSymlink tests that a handler file is reloaded on change, when
+// it was given with a path through a symlinked directory.
+func TestReloadSymlink(t *testing.T) {
+	dir := t.TempDir()
+	real := filepath.Join(dir, "real")
+	if err := os.Mkdir(real, 0755); err != nil {
+		t.Fatalf("Mkdir()=%v", err)
+	}
+	link := filepath.Join(dir, "link")
+	if err := os.Symlink(real, link); err != nil {
+		t.Skipf("Symlink()=%v", err)
+	}
+	file := filepath.Join(link, "handler.tmpl")
+	if err := ioutil.WriteFile(file, []byte("echo old"), 0644); err != nil {
+		t.Fatalf("WriteFile()=%v", err)
+	}
+	h, err := (&handlerSpec{File: file}).handler()
+	if err != nil {
+		t.Fatalf("handler()=%v", err)
+	}
+	w := &watch{handlers: []*handler{h}}
+	r, err := newReloader("", []*watch{w})
+	if err != nil {
+		t.Fatalf("newReloader()=%v", err)
+	}
+	if err := r.Start(); err != nil {
+		t.Fatalf("Start()=%v", err)
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go r.Run(nil, stop)
+	if err := ioutil.WriteFile(file, []byte("echo new"), 0644); err != nil {
+		t.Fatalf("WriteFile()=%v", err)
+	}
+	for i := 0; i < 50; i++ {
+		var buf bytes.Buffer
+		if err := h.template().Execute(&buf, Event{}); err != nil {
+			t.Fatalf("Execute()=%v", err)
+		}
+		if buf.String() == "echo new" {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatal("want handler reloaded after its file was changed")
+}
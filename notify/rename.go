@@ -0,0 +1,84 @@
+package main
+
+import "time"
+
+// moveWait is the time an event for a moved file waits for the event
+// reported for the path the file was moved from.
+const moveWait = 50 * time.Millisecond
+
+// moves relates pairs of events reported for a moved file, in order to set
+// OldPath of the event reported for the new path. As the events may be
+// received in any order, the event for the new path is held for up to
+// moveWait until its counterpart is received.
+type moves struct {
+	from    map[uint32]string // old paths by cookie
+	to      map[uint32]*Event // events for new paths by cookie
+	expired chan uint32
+}
+
+func newMoves() *moves {
+	return &moves{
+		from:    make(map[uint32]string),
+		to:      make(map[uint32]*Event),
+		expired: make(chan uint32),
+	}
+}
+
+// From records the old path of the moved file. It returns the event for
+// the new path, if it was held.
+func (m *moves) From(cookie uint32, path string) (Event, bool) {
+	if e, ok := m.to[cookie]; ok {
+		delete(m.to, cookie)
+		e.OldPath = path
+		return *e, true
+	}
+	m.from[cookie] = path
+	m.expire(cookie)
+	return Event{}, false
+}
+
+// To sets the OldPath of the event for the new path. It returns false if
+// the old path is not yet known, in which case the event is held.
+func (m *moves) To(cookie uint32, e Event) (Event, bool) {
+	if path, ok := m.from[cookie]; ok {
+		delete(m.from, cookie)
+		e.OldPath = path
+		return e, true
+	}
+	m.to[cookie] = &e
+	m.expire(cookie)
+	return Event{}, false
+}
+
+// Expired gives a channel, which receives cookies of the pairs, which
+// waited for their counterparts longer than moveWait.
+func (m *moves) Expired() <-chan uint32 {
+	return m.expired
+}
+
+// Expire forgets the pair for the cookie. It returns the event for the new
+// path, if it was held.
+func (m *moves) Expire(cookie uint32) (Event, bool) {
+	delete(m.from, cookie)
+	if e, ok := m.to[cookie]; ok {
+		delete(m.to, cookie)
+		return *e, true
+	}
+	return Event{}, false
+}
+
+// Flush gives all the held events.
+func (m *moves) Flush() []Event {
+	var events []Event
+	for cookie, e := range m.to {
+		delete(m.to, cookie)
+		events = append(events, *e)
+	}
+	return events
+}
+
+func (m *moves) expire(cookie uint32) {
+	time.AfterFunc(moveWait, func() {
+		m.expired <- cookie
+	})
+}
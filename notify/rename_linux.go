@@ -0,0 +1,23 @@
+package main
+
+import (
+	"github.com/rjeczalik/notify"
+	"golang.org/x/sys/unix"
+)
+
+// moveCookie gives the inotify cookie, which relates the two events
+// reported for a moved file. The to value tells whether the event
+// is reported for the path the file was moved to.
+func moveCookie(ei notify.EventInfo) (cookie uint32, to, ok bool) {
+	sys, ok := ei.Sys().(*unix.InotifyEvent)
+	if !ok || sys.Cookie == 0 {
+		return 0, false, false
+	}
+	switch {
+	case sys.Mask&unix.IN_MOVED_FROM != 0:
+		return sys.Cookie, false, true
+	case sys.Mask&unix.IN_MOVED_TO != 0:
+		return sys.Cookie, true, true
+	}
+	return 0, false, false
+}
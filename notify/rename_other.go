@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "github.com/rjeczalik/notify"
+
+// moveCookie always returns false, as the platform does not relate events
+// reported for a moved file.
+func moveCookie(notify.EventInfo) (cookie uint32, to, ok bool) {
+	return 0, false, false
+}
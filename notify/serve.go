@@ -0,0 +1,36 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+
+	"github.com/rjeczalik/cmd/internal/broadcast"
+	"github.com/rjeczalik/cmd/internal/netz"
+)
+
+// server broadcasts events when the -serve flag is used.
+var server *broadcast.Server
+
+// listen starts serving events on the given address.
+func listen(addr string) error {
+	s := &broadcast.Server{Network: netz.Default}
+	l, err := s.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	log.Printf("serving events on http://%s", l.Addr())
+	go s.Serve(l)
+	server = s
+	return nil
+}
+
+// broadcastEvent sends the event to the clients of the server.
+func broadcastEvent(e Event) {
+	v := newJSONEvent(e)
+	p, err := json.Marshal(v)
+	if err != nil {
+		log.Println("json error:", err)
+		return
+	}
+	server.Send(broadcast.Message{Path: e.Path, Kinds: e.Kinds, Data: p})
+}
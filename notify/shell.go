@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"text/template"
+	"text/template/parse"
+
+	"github.com/rjeczalik/cmd/internal/cmd"
+)
+
+// shellFlag is a flag.Value, which sets the shell the handler's script
+// is run with. When given without a value, the default shell is used.
+type shellFlag struct{}
+
+func (shellFlag) String() string   { return "" }
+func (shellFlag) IsBoolFlag() bool { return true }
+
+func (shellFlag) Set(s string) error {
+	return setShell(options(), s)
+}
+
+func setShell(o *handlerOptions, s string) error {
+	if b, err := strconv.ParseBool(s); err == nil {
+		if o.Shell = nil; b {
+			o.Shell = defaultShell()
+		}
+		return nil
+	}
+	name, args := cmd.Split(s)
+	if name == "" {
+		return fmt.Errorf("invalid shell %q", s)
+	}
+	o.Shell = append([]string{name}, args...)
+	return nil
+}
+
+// defaultShell gives $SHELL -c or, if the variable is not set, /bin/sh -c.
+// On Windows it is cmd /C.
+func defaultShell() []string {
+	if runtime.GOOS == "windows" {
+		return []string{"cmd", "/C"}
+	}
+	if sh := os.Getenv("SHELL"); sh != "" {
+		return []string{sh, "-c"}
+	}
+	return []string{"/bin/sh", "-c"}
+}
+
+// shellquote quotes the value, so it is safe to use it as a single word
+// in a shell script. Slices are quoted element-wise and joined with spaces.
+func shellquote(v interface{}) string {
+	if s, ok := v.([]string); ok {
+		q := make([]string, len(s))
+		for i, s := range s {
+			q[i] = shellquote(s)
+		}
+		return strings.Join(q, " ")
+	}
+	s := fmt.Sprint(v)
+	if s == "" {
+		return "''"
+	}
+	if strings.IndexFunc(s, unsafe) == -1 {
+		return s
+	}
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+func unsafe(r rune) bool {
+	switch {
+	case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		return false
+	}
+	return !strings.ContainsRune("_-./:,+=@%", r)
+}
+
+// raw returns the value as is, it is used to opt out from escaping.
+func raw(v interface{}) string {
+	return fmt.Sprint(v)
+}
+
+// escape makes every action of the template, which produces output,
+// pass its result through shellquote, unless the action already ends
+// with shellquote or raw.
+func escape(tmpl *template.Template) {
+	for _, t := range tmpl.Templates() {
+		if t.Tree != nil {
+			escapeNode(t.Tree, t.Tree.Root)
+		}
+	}
+}
+
+func escapeNode(tree *parse.Tree, node parse.Node) {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, n := range n.Nodes {
+			escapeNode(tree, n)
+		}
+	case *parse.IfNode:
+		escapeNode(tree, n.List)
+		escapeNode(tree, n.ElseList)
+	case *parse.RangeNode:
+		escapeNode(tree, n.List)
+		escapeNode(tree, n.ElseList)
+	case *parse.WithNode:
+		escapeNode(tree, n.List)
+		escapeNode(tree, n.ElseList)
+	case *parse.ActionNode:
+		if len(n.Pipe.Decl) != 0 || len(n.Pipe.Cmds) == 0 {
+			return
+		}
+		last := n.Pipe.Cmds[len(n.Pipe.Cmds)-1]
+		if id, ok := last.Args[0].(*parse.IdentifierNode); ok && (id.Ident == "shellquote" || id.Ident == "raw") {
+			return
+		}
+		quote := parse.NewIdentifier("shellquote").SetTree(tree).SetPos(n.Pos)
+		n.Pipe.Cmds = append(n.Pipe.Cmds, &parse.CommandNode{
+			NodeType: parse.NodeCommand,
+			Pos:      n.Pos,
+			Args:     []parse.Node{quote},
+		})
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"os/exec"
+	"runtime"
+	"testing"
+)
+
+func TestShellquote(t *testing.T) {
+	cases := [...]struct {
+		v     interface{}
+		quote string
+	}{
+		0: {"", "''"},
+		1: {"a/b-c_d.go", "a/b-c_d.go"},
+		2: {"a b", "'a b'"},
+		3: {"it's", `'it'\''s'`},
+		4: {"$(id)", "'$(id)'"},
+		5: {"a;b|c&d", "'a;b|c&d'"},
+		6: {"*.go", "'*.go'"},
+		7: {[]string{"a", "b c"}, "a 'b c'"},
+		8: {42, "42"},
+	}
+	for i, cas := range cases {
+		if quote := shellquote(cas.v); quote != cas.quote {
+			t.Errorf("want quote=%s; got %s (i=%d)", cas.quote, quote, i)
+		}
+	}
+}
+
+func TestEscape(t *testing.T) {
+	e := Event{
+		Path:  "/tmp/a b",
+		Base:  "a b",
+		Kinds: []string{"create", "x y"},
+	}
+	cases := [...]struct {
+		text string
+		out  string
+	}{
+		0: {"echo {{.Path}}", "echo '/tmp/a b'"},
+		1: {"echo {{.Path | shellquote}}", "echo '/tmp/a b'"},
+		2: {"echo {{.Path | raw}}", "echo /tmp/a b"},
+		3: {"{{if .Path}}echo {{.Base}}{{else}}{{.Path}}{{end}}", "echo 'a b'"},
+		4: {"{{range .Kinds}}{{.}} {{end}}", "create 'x y' "},
+		5: {"{{$p := .Base}}echo {{$p}}", "echo 'a b'"},
+		6: {"{{with .OldPath}}{{.}}{{else}}none{{end}}", "none"},
+		7: {`{{define "x"}}{{.Base}}{{end}}echo {{template "x" .}}`, "echo 'a b'"},
+		8: {`echo {{printf "%s.%s" .Base "go"}}`, "echo 'a b.go'"},
+	}
+	for i, cas := range cases {
+		tmpl, err := parseHandler(cas.text, true)
+		if err != nil {
+			t.Errorf("parseHandler()=%v (i=%d)", err, i)
+			continue
+		}
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, e); err != nil {
+			t.Errorf("Execute()=%v (i=%d)", err, i)
+			continue
+		}
+		if out := buf.String(); out != cas.out {
+			t.Errorf("want out=%q; got %q (i=%d)", cas.out, out, i)
+		}
+	}
+}
+
+func TestEscapeShell(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("requires /bin/sh")
+	}
+	paths := []string{
+		"a b",
+		"it's",
+		"$(echo pwned)",
+		"`echo pwned`; echo pwned",
+		"a\nb",
+		"-n",
+	}
+	tmpl, err := parseHandler("printf '%s' {{.Path}}", true)
+	if err != nil {
+		t.Fatalf("parseHandler()=%v", err)
+	}
+	for i, path := range paths {
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, Event{Path: path}); err != nil {
+			t.Fatalf("Execute()=%v (i=%d)", err, i)
+		}
+		out, err := exec.Command("/bin/sh", "-c", buf.String()).Output()
+		if err != nil {
+			t.Errorf("sh -c %q: %v (i=%d)", buf.String(), err, i)
+			continue
+		}
+		if string(out) != path {
+			t.Errorf("want out=%q; got %q (i=%d)", path, out, i)
+		}
+	}
+}
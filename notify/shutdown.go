@@ -0,0 +1,106 @@
+package main
+
+import (
+	"log"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// processes is a set of commands run by the handlers.
+type processes struct {
+	mu    sync.Mutex
+	procs map[*process]struct{}
+}
+
+// running holds the commands, which were started and did not exit yet.
+var running = &processes{procs: make(map[*process]struct{})}
+
+func (ps *processes) add(p *process) {
+	ps.mu.Lock()
+	ps.procs[p] = struct{}{}
+	ps.mu.Unlock()
+}
+
+func (ps *processes) remove(p *process) {
+	ps.mu.Lock()
+	delete(ps.procs, p)
+	ps.mu.Unlock()
+}
+
+// Signal sends the signal to the process groups of the commands. Those
+// which do not exit within their handler's grace period are killed.
+func (ps *processes) Signal(sig syscall.Signal) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	for p := range ps.procs {
+		if err := signalGroup(p.cmd, sig); err != nil {
+			log.Println("handler error:", err)
+		}
+		go func(p *process) {
+			select {
+			case <-p.done:
+			case <-time.After(p.grace):
+				if err := signalGroup(p.cmd, syscall.SIGKILL); err != nil {
+					log.Println("handler error:", err)
+				}
+			}
+		}(p)
+	}
+}
+
+// shutdownTimeout is the time given to the handlers to handle queued events
+// after notify was stopped.
+var shutdownTimeout = 10 * time.Second
+
+// cancel is closed when the handlers are cancelled on shutdown.
+var cancel = make(chan struct{})
+
+// cancelled reports whether the handlers were cancelled on shutdown.
+func cancelled() bool {
+	select {
+	case <-cancel:
+		return true
+	default:
+		return false
+	}
+}
+
+// shutdown waits up to the -shutdown-timeout for the handlers to handle
+// queued events. If they do not finish in time, or another signal is
+// received, the queued events are dropped and the signal is forwarded to
+// the running commands.
+func shutdown(watches []*watch, s os.Signal, sig <-chan os.Signal) {
+	if shutdownTimeout > 0 {
+		select {
+		case <-time.After(shutdownTimeout):
+			log.Printf("handlers did not finish within %s, cancelling", shutdownTimeout)
+		case s = <-sig:
+			log.Printf("received %s, cancelling handlers", s)
+		}
+	}
+	close(cancel)
+	for _, w := range watches {
+		for _, h := range w.handlers {
+			h.queue.Cancel()
+		}
+	}
+	sysSig, ok := s.(syscall.Signal)
+	if !ok {
+		sysSig = syscall.SIGTERM
+	}
+	running.Signal(sysSig)
+}
+
+// exitCode gives the exit status for notify stopped with the signal, which
+// is 128 plus the signal number if the handlers were cancelled.
+func exitCode(s os.Signal) int {
+	if !cancelled() {
+		return 0
+	}
+	if sysSig, ok := s.(syscall.Signal); ok {
+		return 128 + int(sysSig)
+	}
+	return 1
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Settings of the -state flags.
+var (
+	statePath     string
+	stateHash     bool
+	stateInterval = time.Minute
+)
+
+// stateFile is the format of the file written with the -state flag.
+type stateFile struct {
+	Time        time.Time                        `json:"time"`
+	Watchpoints map[string]map[string]stateEntry `json:"watchpoints"`
+}
+
+// stateEntry is a state of a single file.
+type stateEntry struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+	Inode   uint64    `json:"inode,omitempty"`
+	Dir     bool      `json:"dir,omitempty"`
+	Hash    string    `json:"hash,omitempty"`
+}
+
+// state keeps snapshots of the watched trees in a file, in order to report
+// changes made while notify was not running.
+type state struct {
+	mu      sync.Mutex
+	file    string
+	hash    bool
+	watches []*watch
+}
+
+func newState(file string, hash bool, watches []*watch) *state {
+	return &state{file: file, hash: hash, watches: watches}
+}
+
+// key identifies the watchpoint in the state file.
+func key(wp *watchpoint) string {
+	if strings.HasSuffix(wp.Path, "...") {
+		return filepath.Join(wp.Root, "...")
+	}
+	return wp.Root
+}
+
+// Restore reads the state file and compares the snapshots with the current
+// state of the watched trees. Events for the differences are sent by
+// the watches before the received ones. Watchpoints missing from the file
+// have no events.
+func (s *state) Restore() error {
+	p, err := ioutil.ReadFile(s.file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var sf stateFile
+	if err := json.Unmarshal(p, &sf); err != nil {
+		return fmt.Errorf("%s: %s", s.file, err)
+	}
+	for _, w := range s.watches {
+		for _, wp := range w.wps {
+			entries, ok := sf.Watchpoints[key(wp)]
+			if !ok {
+				continue
+			}
+			old := make(map[string]fileState, len(entries))
+			for path, e := range entries {
+				old[path] = fileState{
+					size:  e.Size,
+					mtime: e.ModTime,
+					ino:   e.Inode,
+					dir:   e.Dir,
+					hash:  e.Hash,
+				}
+			}
+			cur := make(map[string]fileState)
+			scan(cur, wp, s.hash)
+			w.missed = append(w.missed, diff(old, cur)...)
+		}
+	}
+	return nil
+}
+
+// Save writes snapshots of the watched trees to the state file.
+func (s *state) Save() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sf := stateFile{
+		Time:        time.Now(),
+		Watchpoints: make(map[string]map[string]stateEntry),
+	}
+	for _, w := range s.watches {
+		for _, wp := range w.wps {
+			snap := make(map[string]fileState)
+			scan(snap, wp, s.hash)
+			entries := make(map[string]stateEntry, len(snap))
+			for path, st := range snap {
+				entries[path] = stateEntry{
+					Size:    st.size,
+					ModTime: st.mtime,
+					Inode:   st.ino,
+					Dir:     st.dir,
+					Hash:    st.hash,
+				}
+			}
+			sf.Watchpoints[key(wp)] = entries
+		}
+	}
+	p, err := json.Marshal(sf)
+	if err != nil {
+		return err
+	}
+	// The file is replaced atomically, so it is never left half-written.
+	tmp := s.file + ".tmp"
+	if err := ioutil.WriteFile(tmp, p, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.file)
+}
+
+// Run saves the state every interval until the stop channel is closed.
+func (s *state) Run(interval time.Duration, stop <-chan struct{}) {
+	if interval <= 0 {
+		return
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			if err := s.Save(); err != nil {
+				log.Println("state error:", err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
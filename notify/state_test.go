@@ -0,0 +1,107 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/rjeczalik/notify"
+)
+
+func writeFiles(t *testing.T, dir string, files ...string) {
+	for _, file := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, file), []byte(file), 0644); err != nil {
+			t.Fatalf("WriteFile()=%v", err)
+		}
+	}
+}
+
+func TestStateRestore(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(t.TempDir(), "state.json")
+	writeFiles(t, dir, "a", "b", "c", "d")
+	newWatchState := func() (*watch, *state) {
+		w, err := newWatch([]string{filepath.Join(dir, "...")}, false)
+		if err != nil {
+			t.Fatalf("newWatch()=%v", err)
+		}
+		return w, newState(file, true, []*watch{w})
+	}
+	w, st := newWatchState()
+	if err := st.Restore(); err != nil {
+		t.Fatalf("Restore()=%v", err)
+	}
+	if len(w.missed) != 0 {
+		t.Fatalf("want no missed events without state file; got %v", w.missed)
+	}
+	if err := st.Save(); err != nil {
+		t.Fatalf("Save()=%v", err)
+	}
+	if _, err := os.Stat(file + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("want temporary file removed; got %v", err)
+	}
+	// With hashes a file rewritten with the same content is not reported.
+	writeFiles(t, dir, "a", "e")
+	if err := ioutil.WriteFile(filepath.Join(dir, "b"), []byte("changed"), 0644); err != nil {
+		t.Fatalf("WriteFile()=%v", err)
+	}
+	if err := os.Remove(filepath.Join(dir, "c")); err != nil {
+		t.Fatalf("Remove()=%v", err)
+	}
+	w, st = newWatchState()
+	if err := st.Restore(); err != nil {
+		t.Fatalf("Restore()=%v", err)
+	}
+	got := make([]string, 0, len(w.missed))
+	for _, e := range w.missed {
+		got = append(got, mapping[e.Event()]+" "+filepath.Base(e.Path()))
+	}
+	sort.Strings(got)
+	if want := []string{"create e", "remove c", "write b"}; !equal(got, want) {
+		t.Errorf("want missed=%q; got %q", want, got)
+	}
+	if err := ioutil.WriteFile(file, []byte("{"), 0644); err != nil {
+		t.Fatalf("WriteFile()=%v", err)
+	}
+	if err := st.Restore(); err == nil {
+		t.Error("want err!=nil for corrupted state file")
+	}
+}
+
+// TestMissedBusyHandler tests that missed events are not dropped by a busy
+// handler with the default queue policy.
+func TestMissedBusyHandler(t *testing.T) {
+	dir := t.TempDir()
+	out := filepath.Join(t.TempDir(), "out")
+	w, err := newWatch([]string{filepath.Join(dir, "...")}, false)
+	if err != nil {
+		t.Fatalf("newWatch()=%v", err)
+	}
+	for _, file := range []string{"a", "b", "c", "d"} {
+		w.missed = append(w.missed, pollEvent{path: filepath.Join(dir, file), event: notify.Create})
+	}
+	h := newShellHandler(t, "sleep 0.05; echo {{.Rel}} >> "+shellquote(out), handlerOptions{})
+	w.handlers = append(w.handlers, h)
+	h.Daemon()
+	close(w.c)
+	done := make(chan struct{})
+	go func() {
+		w.Run()
+		h.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("handler did not finish")
+	}
+	if want, got := []string{"a", "b", "c", "d"}, readLines(t, out); !equal(got, want) {
+		t.Errorf("want runs=%q; got %q", want, got)
+	}
+	if n := h.queue.Dropped(); n != 0 {
+		t.Errorf("want dropped=0; got %d", n)
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/rjeczalik/notify"
+)
+
+// watch listens on a set of paths and forwards events, which pass its
+// filter, to its handlers.
+type watch struct {
+	wps      []*watchpoint
+	events   notify.Event
+	filter   filter
+	debounce time.Duration
+	handlers []*handler
+	c        chan notify.EventInfo
+
+	// poll is the polling interval. If fallback is false, all the paths
+	// are polled, otherwise only those notify failed to watch.
+	poll     time.Duration
+	fallback bool
+	poller   *poller
+
+	// missed holds events for changes made while notify was not running,
+	// which are sent before the received ones.
+	missed []pollEvent
+
+	// replayFile, when not empty, is read for recorded events instead
+	// of listening on the paths.
+	replayFile string
+	speed      speed
+}
+
+// newWatch creates a watch for the given paths. If ignored is true,
+// ignore rules are read from .notifyignore files.
+func newWatch(paths []string, ignored bool) (*watch, error) {
+	w := &watch{
+		events: notify.All,
+		c:      make(chan notify.EventInfo, 1),
+	}
+	for _, path := range paths {
+		wp, err := newWatchpoint(path)
+		if err != nil {
+			return nil, err
+		}
+		if ignored {
+			if err := wp.readIgnore(); err != nil {
+				return nil, err
+			}
+		}
+		w.wps = append(w.wps, wp)
+	}
+	return w, nil
+}
+
+// Start starts the handlers and starts listening on the paths.
+func (w *watch) Start() error {
+	for _, h := range w.handlers {
+		h.Daemon()
+	}
+	if w.replayFile != "" {
+		return nil
+	}
+	var polled []*watchpoint
+	for _, wp := range w.wps {
+		if w.poll > 0 && !w.fallback {
+			polled = append(polled, wp)
+			continue
+		}
+		if err := notify.Watch(wp.Path, w.c, w.events); err != nil {
+			if !w.fallback {
+				notify.Stop(w.c)
+				return err
+			}
+			log.Printf("watching %s failed, falling back to polling: %s", wp.Path, err)
+			polled = append(polled, wp)
+		}
+	}
+	if len(polled) != 0 {
+		if w.poll <= 0 {
+			w.poll = defaultPoll
+		}
+		w.poller = newPoller(polled)
+	}
+	return nil
+}
+
+// Stop stops listening on the paths, which makes Run return after all
+// the received events are handled.
+func (w *watch) Stop() {
+	notify.Stop(w.c)
+	close(w.c)
+}
+
+// Run forwards received events to the handlers until the watch is stopped.
+func (w *watch) Run() {
+	events := make(chan Event)
+	if w.replayFile != "" {
+		go w.replay(events)
+	} else {
+		go w.read(events)
+	}
+	var in <-chan Event = events
+	if rec != nil {
+		in = rec.Tee(in)
+	}
+	if w.debounce > 0 {
+		in = coalesce(in, w.debounce)
+	}
+	for e := range in {
+		var accepted []*handler
+		for _, h := range w.handlers {
+			if h.accepts(e) {
+				accepted = append(accepted, h)
+			}
+		}
+		// With -once only an event accepted by any of the handlers
+		// counts as handled.
+		handle := len(accepted) != 0 || len(w.handlers) == 0
+		if once && handle && !first() {
+			break
+		}
+		if jsonOut {
+			if err := printJSON(os.Stdout, e); err != nil {
+				log.Println("json error:", err)
+			}
+		}
+		if server != nil {
+			broadcastEvent(e)
+		}
+		for _, h := range accepted {
+			if !h.Send(e) {
+				log.Println("event dropped due to slow handler")
+			}
+		}
+		if once && handle {
+			if len(w.handlers) == 0 && !jsonOut {
+				fmt.Println(e.Path)
+			}
+			close(done)
+			break
+		}
+	}
+	for _, h := range w.handlers {
+		h.Close()
+	}
+	go func() {
+		for range in {
+		}
+	}()
+}
+
+// ownFiles holds absolute paths of the files written by notify itself, like
+// the -record and -state files. Events for them are dropped, otherwise writing the file
+// would generate events, which would be written to the file again.
+var ownFiles = make(map[string]bool)
+
+// addOwnFile adds the file to ownFiles both as given and with symlinks
+// resolved, as the latter is used in the events received from notify.
+func addOwnFile(file string) error {
+	abs, err := filepath.Abs(file)
+	if err != nil {
+		return err
+	}
+	ownFiles[abs] = true
+	ownFiles[realpath(abs)] = true
+	return nil
+}
+
+// realpath gives the absolute path of the file with symlinks in its directory
+// resolved, as in the events received from notify. If the directory does not
+// exist, the path is returned unchanged.
+func realpath(abs string) string {
+	dir, err := filepath.EvalSymlinks(filepath.Dir(abs))
+	if err != nil {
+		return abs
+	}
+	return filepath.Join(dir, filepath.Base(abs))
+}
+
+// done is closed after the first event was handled with the -once flag.
+var done = make(chan struct{})
+
+var handled int32
+
+// first reports whether it was called for the first time.
+func first() bool {
+	return atomic.CompareAndSwapInt32(&handled, 0, 1)
+}
+
+// read turns events received from notify into Events and sends them
+// to the given channel, which is closed after the watch is stopped.
+func (w *watch) read(events chan<- Event) {
+	m := newMoves()
+	var tick <-chan time.Time
+	if w.poller != nil {
+		t := time.NewTicker(w.poll)
+		defer t.Stop()
+		tick = t.C
+	}
+	for _, ei := range w.missed {
+		w.synthesize(events, ei, "missed")
+	}
+	for {
+		select {
+		case ei, ok := <-w.c:
+			if !ok {
+				for _, e := range m.Flush() {
+					events <- e
+				}
+				close(events)
+				return
+			}
+			if ownFiles[ei.Path()] {
+				continue
+			}
+			cookie, to, moved := moveCookie(ei)
+			if moved && !to {
+				if e, ok := m.From(cookie, ei.Path()); ok {
+					events <- e
+				}
+			}
+			wp := lookup(w.wps, ei.Path())
+			if !w.filter.match(wp, ei.Path()) {
+				continue
+			}
+			log.Println("received", ei)
+			e := newEvent(ei, wp)
+			if moved && to {
+				if e, ok = m.To(cookie, e); !ok {
+					continue
+				}
+			}
+			events <- e
+		case cookie := <-m.Expired():
+			if e, ok := m.Expire(cookie); ok {
+				events <- e
+			}
+		case <-tick:
+			for _, ei := range w.poller.Poll() {
+				w.synthesize(events, ei, "polled")
+			}
+		}
+	}
+}
+
+// synthesize sends the event to the given channel, if it passes the filter.
+func (w *watch) synthesize(events chan<- Event, ei pollEvent, how string) {
+	wp := lookup(w.wps, ei.Path())
+	if ownFiles[ei.Path()] || w.events&ei.Event() == 0 || !w.filter.match(wp, ei.Path()) {
+		return
+	}
+	log.Println(how, ei)
+	e := newEvent(ei, wp)
+	e.OldPath = ei.oldPath
+	// Missed changes are not reported again, so they must not be dropped.
+	e.keep = how == "missed"
+	events <- e
+}
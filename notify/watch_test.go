@@ -0,0 +1,47 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/rjeczalik/notify"
+)
+
+func TestReadOwnFiles(t *testing.T) {
+	dir := t.TempDir()
+	w, err := newWatch([]string{filepath.Join(dir, "...")}, false)
+	if err != nil {
+		t.Fatalf("newWatch()=%v", err)
+	}
+	own := filepath.Join(dir, "ev.jsonl")
+	if err := addOwnFile(own); err != nil {
+		t.Fatalf("addOwnFile()=%v", err)
+	}
+	defer func() { ownFiles = make(map[string]bool) }()
+	w.missed = []pollEvent{
+		{path: own, event: notify.Write},
+		{path: filepath.Join(dir, "b.txt"), event: notify.Create},
+	}
+	events := make(chan Event)
+	go w.read(events)
+	go func() {
+		w.c <- pollEvent{path: own, event: notify.Write}
+		w.c <- pollEvent{path: filepath.Join(dir, "a.txt"), event: notify.Write}
+		w.c <- pollEvent{path: own, event: notify.Write}
+		close(w.c)
+	}()
+	var got []string
+	for e := range events {
+		got = append(got, e.Base)
+	}
+	want := []string{"b.txt", "a.txt"}
+	if len(got) != len(want) {
+		t.Fatalf("want events=%v; got %v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("want events=%v; got %v", want, got)
+			break
+		}
+	}
+}